@@ -6,24 +6,45 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"html/template"
+	"io"
+	"log"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/mxk/go-sqlite/sqlite3"
 	"golang.org/x/crypto/bcrypt"
 )
 
-const queryLimit = 100
+const (
+	queryLimit = 100
+	dbVersion  = 9
+)
 
 type DB struct {
-	db  *sql.DB
-	git *GitRepo
+	db          *sql.DB
+	git         *GitRepo
+	maxNotes    int           // maximum number of notes (if positive)
+	maxNoteSize int           // maximum size of note text in bytes (if positive)
+	maxFailures int           // failed logins after which account is locked (if positive)
+	lockout     time.Duration // duration of the account lock
+	minPassword int           // minimum length of passwords of added users
+	slowQuery   time.Duration // queries taking longer are logged (if positive)
+	tagCache    *tagCache
+	stmts       *stmtCache // prepared statements of the hot read paths
+	events      *eventHub  // receives note events (if not nil)
+	filename    string     // database file name (empty if in memory)
 }
 
 var (
@@ -31,6 +52,12 @@ var (
 	ErrTagName      = errors.New("unexpected tag name in query result")
 	ErrAuth         = errors.New("failed to authenticate")
 	ErrNoTags       = errors.New("no tags specified")
+	ErrNotInit      = errors.New("database not initialized, run -init")
+	ErrTooManyNotes = errors.New("maximum number of notes reached")
+	ErrNoteTooLong  = errors.New("note is too long")
+	ErrNoUser       = errors.New("no such user")
+	ErrTOTPRequired = errors.New("authentication code required")
+	ErrNoNotes      = errors.New("no notes matched")
 )
 
 func OpenDB(filename string) (*DB, error) {
@@ -41,52 +68,243 @@ func OpenDB(filename string) (*DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &DB{db, NewGitRepo(filename + ".git")}, nil
+	return &DB{db, NewGitRepo(filename + ".git"), 0, 0, 0, 0, 0, 0, &tagCache{}, newStmtCache(db), nil, filename}, nil
 }
 
-type Querier interface {
-	Query(query string, args ...interface{}) (*sql.Rows, error)
+// memoryDBs counts databases opened with OpenDBMemory so that every
+// one of them gets a distinct name.
+var memoryDBs int64
+
+// OpenDBMemory opens a new initialized database kept in memory and
+// not backed by git. It is meant for tests and benchmarks.
+func OpenDBMemory() (*DB, error) {
+	if sqlite3.SingleThread() {
+		return nil, ErrSingleThread
+	}
+	// shared cache so that all the connections of the pool see
+	// the same database
+	name := fmt.Sprintf("file:pns-memory-%d?mode=memory&cache=shared", atomic.AddInt64(&memoryDBs, 1))
+	db, err := sql.Open("sqlite3", name)
+	if err != nil {
+		return nil, err
+	}
+	// the database is gone when its last connection is closed
+	db.SetMaxIdleConns(1 << 10)
+	mdb := &DB{db, nil, 0, 0, 0, 0, 0, 0, &tagCache{}, newStmtCache(db), nil, ""}
+	if err = mdb.Init(false, "en", false); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return mdb, nil
 }
 
-func (db *DB) Init(useGit bool, lang string) (err error) {
-	tx, err := db.db.Begin()
+// Backup writes a consistent copy of the database (taken with the
+// SQLite online backup API while the database may be in use) to the
+// file dest, which must not exist. The git repository is not included.
+func (db *DB) Backup(dest string) (err error) {
+	if db.filename == "" {
+		return errors.New("cannot back up in-memory database")
+	}
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("backup file %s already exists", dest)
+	}
+	src, err := sqlite3.Open(db.filename)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	defer src.Close()
+	dst, err := sqlite3.Open(dest)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	b, err := src.Backup("main", dst, "main")
+	if err != nil {
+		return err
+	}
+	if err = b.Step(-1); err == io.EOF {
+		err = nil
+	}
+	if cerr := b.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
 
-	err = createPNSTable(tx, useGit, lang)
-	if err == nil {
-		_, err = tx.Exec("CREATE TABLE notes(note TEXT, created INTEGER, modified INTEGER)")
+// BackupWithoutUsers is like Backup but the users (with their password
+// hashes and TOTP secrets) are removed from the copy.
+func (db *DB) BackupWithoutUsers(dest string) (err error) {
+	if err = db.Backup(dest); err != nil {
+		return err
 	}
-	if err == nil {
-		_, err = tx.Exec("CREATE VIRTUAL TABLE ftsnotes USING fts4(note)")
+	c, err := sqlite3.Open(dest)
+	if err != nil {
+		return err
 	}
-	if err == nil {
-		_, err = tx.Exec("CREATE TABLE tags(noteid INTEGER, tagid INTEGER)")
+	defer func() {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	if err = c.Exec("DELETE FROM users"); err != nil {
+		return err
 	}
-	if err == nil {
-		_, err = tx.Exec("CREATE UNIQUE INDEX tagsIds ON tags (noteid, tagid)")
+	// rebuild the file so that deleted rows do not remain in free pages
+	return c.Exec("VACUUM")
+}
+
+type Querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// stmtCache prepares fixed-shape queries on first use and reuses the
+// prepared statements afterwards. It implements Querier.
+type stmtCache struct {
+	db *sql.DB
+	mu sync.Mutex
+	m  map[string]*sql.Stmt
+}
+
+func newStmtCache(db *sql.DB) *stmtCache {
+	return &stmtCache{db: db, m: make(map[string]*sql.Stmt)}
+}
+
+// Stmt returns the prepared statement for the given query.
+func (c *stmtCache) Stmt(query string) (*sql.Stmt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if stmt, ok := c.m[query]; ok {
+		return stmt, nil
 	}
-	if err == nil {
-		_, err = tx.Exec("CREATE INDEX tagsTagId ON tags (tagid)")
+	stmt, err := c.db.Prepare(query)
+	if err != nil {
+		return nil, err
 	}
-	if err == nil {
-		_, err = tx.Exec("CREATE TABLE tagnames(name TEXT UNIQUE)")
+	c.m[query] = stmt
+	return stmt, nil
+}
+
+func (c *stmtCache) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.WithContext(context.Background()).Query(query, args...)
+}
+
+// WithContext returns Querier using the prepared statements of the
+// cache which stops reading rows when the context is done. The
+// sqlite driver does not support contexts so a statement already
+// being executed is not interrupted, only no more rows are read.
+func (c *stmtCache) WithContext(ctx context.Context) Querier {
+	return contextStmtCache{c, ctx}
+}
+
+// beginContext begins a transaction on a connection of its own which
+// is interrupted when the context is done (as the sqlite driver does
+// not support contexts a running statement would not be stopped
+// otherwise). The returned function must be called (after the
+// transaction is finished) to release the connection.
+func (db *DB) beginContext(ctx context.Context) (*sql.Tx, func(), error) {
+	conn, err := db.db.Conn(ctx)
+	if err != nil {
+		return nil, nil, err
 	}
-	if err == nil {
-		_, err = tx.Exec("CREATE TABLE users(login TEXT UNIQUE, passwordhash BLOB)")
+	var interrupt func()
+	err = conn.Raw(func(c interface{}) error {
+		// sqlite3_interrupt may be called from any goroutine and the
+		// connection is ours until conn.Close
+		if i, ok := c.(interface{ Interrupt() }); ok {
+			interrupt = i.Interrupt
+		}
+		return nil
+	})
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			if interrupt != nil {
+				interrupt()
+			}
+		case <-stop:
+		}
+	}()
+	return tx, func() {
+		close(stop)
+		<-stopped
+		conn.Close()
+	}, nil
+}
+
+type contextStmtCache struct {
+	c   *stmtCache
+	ctx context.Context
+}
+
+func (q contextStmtCache) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := q.c.Stmt(query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.QueryContext(q.ctx, args...)
+}
+
+var initStatements = []string{
+	"CREATE TABLE notes(note TEXT, created INTEGER, modified INTEGER, deleted_at INTEGER NOT NULL DEFAULT 0, copied_from INTEGER NOT NULL DEFAULT 0, last_viewed INTEGER NOT NULL DEFAULT 0)",
+	"CREATE VIRTUAL TABLE ftsnotes USING fts4(note, title)",
+	"CREATE TABLE tags(noteid INTEGER, tagid INTEGER)",
+	"CREATE UNIQUE INDEX tagsIds ON tags (noteid, tagid)",
+	"CREATE INDEX tagsTagId ON tags (tagid)",
+	"CREATE INDEX notesCreated ON notes (created)",
+	"CREATE INDEX notesModified ON notes (modified)",
+	"CREATE TABLE tagnames(name TEXT UNIQUE)",
+	"CREATE TABLE users(login TEXT UNIQUE, passwordhash BLOB, failed_attempts INTEGER NOT NULL DEFAULT 0, locked_until INTEGER NOT NULL DEFAULT 0, totp_secret TEXT NOT NULL DEFAULT '', totp_step INTEGER NOT NULL DEFAULT 0)",
+}
+
+// Init creates tables of a new database. In dry run mode the changes
+// are rolled back and only printed to standard output.
+func (db *DB) Init(useGit bool, lang string, dryRun bool) (err error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = createPNSTable(tx, dbVersion, useGit, lang)
+	for _, stmt := range initStatements {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec(stmt)
 	}
 	if err != nil {
 		return err
 	}
+	if dryRun {
+		fmt.Printf("dry run: would create table pns (db_version=%d, use_git=%v, lang=%s)\n", dbVersion, useGit, lang)
+		for _, stmt := range initStatements {
+			fmt.Printf("dry run: would execute %s\n", stmt)
+		}
+		return nil
+	}
 	return tx.Commit()
 }
 
-func createPNSTable(tx *sql.Tx, useGit bool, lang string) error {
+func createPNSTable(tx *sql.Tx, version int, useGit bool, lang string) error {
 	_, err := tx.Exec("CREATE TABLE pns(key TEXT UNIQUE, value TEXT)")
 	if err == nil {
-		_, err = tx.Exec("INSERT INTO pns (key, value) VALUES ('db_version', '1')")
+		_, err = tx.Exec("INSERT INTO pns (key, value) VALUES ('db_version', ?)", strconv.Itoa(version))
 	}
 	if err == nil {
 		_, err = tx.Exec("INSERT INTO pns (key, value) VALUES ('use_git', ?)", useGit)
@@ -97,6 +315,177 @@ func createPNSTable(tx *sql.Tx, useGit bool, lang string) error {
 	return err
 }
 
+var schemaTables = []string{"pns", "notes", "ftsnotes", "tags", "tagnames", "users"}
+
+// FTSMismatchError is returned by CheckFTSConsistency if the number of
+// notes differs from the number of entries of the full text search
+// index.
+type FTSMismatchError struct {
+	Notes, FTS int
+}
+
+func (e FTSMismatchError) Error() string {
+	return fmt.Sprintf("full text search index has %d entries for %d notes, search results may be incomplete (use -reindex)", e.FTS, e.Notes)
+}
+
+// CheckFTSConsistency returns FTSMismatchError if the number of notes
+// (including those in the trash) differs from the number of entries of
+// the full text search index.
+func (db *DB) CheckFTSConsistency() error {
+	var notes, fts int
+	err := db.db.QueryRow("SELECT COUNT(*) FROM notes").Scan(&notes)
+	if err == nil {
+		err = db.db.QueryRow("SELECT COUNT(*) FROM ftsnotes").Scan(&fts)
+	}
+	if err != nil {
+		return err
+	}
+	if notes != fts {
+		return FTSMismatchError{notes, fts}
+	}
+	return nil
+}
+
+// OrphanNotes returns IDs of notes (including those in the trash)
+// without any topics or tags, which cannot be found by browsing.
+func (db *DB) OrphanNotes() ([]int64, error) {
+	return db.orphanNotes(true)
+}
+
+// orphanNotes is like OrphanNotes but notes in the trash are returned
+// only if withTrash is true.
+func (db *DB) orphanNotes(withTrash bool) ([]int64, error) {
+	query := "SELECT rowid FROM notes WHERE rowid NOT IN (SELECT noteid FROM tags) ORDER BY rowid"
+	if !withTrash {
+		query = "SELECT rowid FROM notes WHERE rowid NOT IN (SELECT noteid FROM tags) AND deleted_at=0 ORDER BY rowid"
+	}
+	rows, err := db.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// TagOrphanNotes adds the given topic (or tag) to the notes returned
+// by OrphanNotes except those in the trash (recording the change in the
+// git history as an edit) and returns their IDs.
+func (db *DB) TagOrphanNotes(topic string) ([]int64, error) {
+	ids, err := db.orphanNotes(false)
+	if err != nil {
+		return nil, err
+	}
+	for i, id := range ids {
+		note, err := db.Note(id)
+		if err != nil {
+			return ids[:i], err
+		}
+		if err = db.updateNote(id, note.Text, []string{topic}, note.sha1sum()); err != nil {
+			return ids[:i], err
+		}
+	}
+	return ids, nil
+}
+
+// Reindex rebuilds the full text search index from the notes and
+// returns the number of indexed notes.
+func (db *DB) Reindex() (int, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT rowid, note FROM notes")
+	if err != nil {
+		return 0, err
+	}
+	texts := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var text string
+		if err := rows.Scan(&id, &text); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		texts[id] = text
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if _, err = tx.Exec("DELETE FROM ftsnotes"); err != nil {
+		return 0, err
+	}
+	for id, text := range texts {
+		_, err = tx.Exec("INSERT INTO ftsnotes (docid, note, title) VALUES (?, ?, ?)", id, text, noteTitle(text))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(texts), tx.Commit()
+}
+
+// CheckSchema returns an error if some of the expected tables is
+// missing or the database version is other than expected.
+func (db *DB) CheckSchema() error {
+	query := fmt.Sprintf("SELECT name FROM sqlite_master WHERE type='table' AND name IN (%s)", questionMarks(len(schemaTables)))
+	rows, err := db.db.Query(query, stringsAsEmptyInterface(schemaTables)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	m := make(map[string]struct{})
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		m[name] = struct{}{}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(m) == 0 {
+		return ErrNotInit
+	}
+	var missing []string
+	for _, name := range schemaTables {
+		if _, present := m[name]; !present {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 1 && missing[0] == "pns" {
+		return errors.New("missing table pns (use -update)")
+	} else if len(missing) > 0 {
+		return fmt.Errorf("missing tables: %s", strings.Join(missing, ", "))
+	}
+
+	var value string
+	if err := db.db.QueryRow("SELECT value FROM pns WHERE key='db_version'").Scan(&value); err == sql.ErrNoRows {
+		return errors.New("missing db_version in pns table")
+	} else if err != nil {
+		return err
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("error parsing db_version: %v", err)
+	}
+	if version != dbVersion {
+		return fmt.Errorf("expected db_version %d but found %d (use -migrate)", dbVersion, version)
+	}
+	return nil
+}
+
 func (db *DB) getPNSOptions() (git bool, lang string, err error) {
 	rows, err := db.db.Query("SELECT key, value FROM pns")
 	if err != nil {
@@ -117,8 +506,8 @@ func (db *DB) getPNSOptions() (git bool, lang string, err error) {
 			if err != nil {
 				return false, "", fmt.Errorf("error parsing db_version: %v", err)
 			}
-			if i != 1 {
-				return false, "", fmt.Errorf("expected db_version 1 but found %d", i)
+			if i != dbVersion {
+				return false, "", fmt.Errorf("expected db_version %d but found %d (use -migrate)", dbVersion, i)
 			}
 		case "use_git":
 			mask |= 2
@@ -145,12 +534,45 @@ func (db *DB) getPNSOptions() (git bool, lang string, err error) {
 	return
 }
 
-func (db *DB) Import(notes []*Note) (err error) {
+// Import inserts the notes into the database.  If keepIDs is true IDs
+// of the notes (if given) are preserved unless a note with such ID
+// already exists (then a new ID is assigned as usual).
+func (db *DB) Import(notes []*Note, keepIDs bool) (err error) {
+	_, _, err = db.importNotes(notes, keepIDs)
+	return err
+}
+
+// Merge inserts the notes (e.g., all notes of another database) into
+// the database preserving their IDs unless already used (then a new ID
+// is assigned) and reusing existing tag names.  It returns the number
+// of added notes and the number of added tag names.
+func (db *DB) Merge(notes []*Note) (addedNotes, addedTags int, err error) {
+	return db.importNotes(notes, true)
+}
+
+func (db *DB) importNotes(notes []*Note, keepIDs bool) (addedNotes, addedTags int, err error) {
+	if keepIDs {
+		if err := checkDuplicateIDs(notes); err != nil {
+			return 0, 0, err
+		}
+	}
 	tx, err := db.db.Begin()
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 	defer tx.Rollback()
+	defer db.InvalidateTags()
+
+	ids := make([]int64, len(notes))
+	if keepIDs {
+		if ids, err = freeIDs(tx, notes); err != nil {
+			return 0, 0, err
+		}
+		// insert notes with preserved IDs first so that they are
+		// not taken by the notes with automatically assigned IDs
+		notes = append([]*Note(nil), notes...)
+		sort.Stable(byPreservedID{notes, ids})
+	}
 
 	m := make(map[string]int64)
 	for _, n := range notes {
@@ -163,67 +585,378 @@ func (db *DB) Import(notes []*Note) (err error) {
 	}
 
 	for k := range m {
+		var id int64
+		err := tx.QueryRow("SELECT rowid FROM tagnames WHERE name=?", k).Scan(&id)
+		if err == nil {
+			m[k] = id
+			continue
+		}
+		if err != sql.ErrNoRows {
+			return 0, 0, err
+		}
 		result, err := tx.Exec("INSERT INTO tagnames VALUES(?)", k)
 		if err != nil {
-			return err
+			return 0, 0, err
 		}
 		m[k], err = result.LastInsertId()
 		if err != nil {
-			return err
+			return 0, 0, err
 		}
+		addedTags++
 	}
 
-	for _, n := range notes {
-		result, err := tx.Exec("INSERT INTO notes (note, created, modified) VALUES(?, ?, ?)",
-			n.Text, n.Created, n.Modified)
+	for i, n := range notes {
+		var result sql.Result
+		if ids[i] > 0 {
+			result, err = tx.Exec("INSERT INTO notes (rowid, note, created, modified) VALUES(?, ?, ?, ?)",
+				ids[i], n.Text, n.Created, n.Modified)
+		} else {
+			result, err = tx.Exec("INSERT INTO notes (note, created, modified) VALUES(?, ?, ?)",
+				n.Text, n.Created, n.Modified)
+		}
 		if err != nil {
-			return err
+			return 0, 0, err
 		}
 		noteid, err := result.LastInsertId()
 		if err != nil {
-			return err
+			return 0, 0, err
 		}
-		_, err = tx.Exec("INSERT INTO ftsnotes (docid, note) VALUES (?, ?)", noteid, n.Text)
+		_, err = tx.Exec("INSERT INTO ftsnotes (docid, note, title) VALUES (?, ?, ?)", noteid, n.Text, noteTitle(n.Text))
 		if err != nil {
+			return 0, 0, err
+		}
+
+		for _, s := range n.Topics {
+			_, err := tx.Exec("INSERT INTO tags (noteid, tagid) VALUES(?, ?)", noteid, m[s])
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+		for _, s := range n.Tags {
+			_, err := tx.Exec("INSERT INTO tags (noteid, tagid) VALUES(?, ?)", noteid, m[s])
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+		addedNotes++
+	}
+	if err = touch(tx); err != nil {
+		return 0, 0, err
+	}
+	return addedNotes, addedTags, tx.Commit()
+}
+
+// checkDuplicateIDs returns an error if any (non-zero) note ID occurs
+// more than once.
+func checkDuplicateIDs(notes []*Note) error {
+	m := make(map[int64]bool)
+	for _, n := range notes {
+		if n.ID == 0 {
+			continue
+		}
+		if m[n.ID] {
+			return fmt.Errorf("duplicate note ID %d", n.ID)
+		}
+		m[n.ID] = true
+	}
+	return nil
+}
+
+// freeIDs returns for each note its ID if it is not already used in
+// the database (including notes in the trash) or 0 otherwise.
+func freeIDs(tx *sql.Tx, notes []*Note) ([]int64, error) {
+	var n int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM notes").Scan(&n); err != nil {
+		return nil, err
+	}
+	ids := make([]int64, len(notes))
+	for i, note := range notes {
+		if note.ID <= 0 {
+			continue
+		}
+		if n > 0 {
+			var id int64
+			err := tx.QueryRow("SELECT rowid FROM notes WHERE rowid=?", note.ID).Scan(&id)
+			if err == nil {
+				continue
+			}
+			if err != sql.ErrNoRows {
+				return nil, err
+			}
+		}
+		ids[i] = note.ID
+	}
+	return ids, nil
+}
+
+// byPreservedID sorts notes with preserved IDs (non-zero ids) before
+// other notes.
+type byPreservedID struct {
+	notes []*Note
+	ids   []int64
+}
+
+func (a byPreservedID) Len() int           { return len(a.notes) }
+func (a byPreservedID) Less(i, j int) bool { return a.ids[i] > 0 && a.ids[j] == 0 }
+func (a byPreservedID) Swap(i, j int) {
+	a.notes[i], a.notes[j] = a.notes[j], a.notes[i]
+	a.ids[i], a.ids[j] = a.ids[j], a.ids[i]
+}
+
+// AddUser adds user with the given login and password (which must
+// pass checkPassword).
+func (db *DB) AddUser(login string, password []byte) error {
+	if err := checkPassword(login, string(password), db.minPassword); err != nil {
+		return err
+	}
+	p, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	_, err = db.db.Exec("INSERT INTO users (login, passwordhash) VALUES (?, ?)", login, p)
+	return err
+}
+
+// Users returns the logins of all the users (ordered by login).
+func (db *DB) Users() ([]string, error) {
+	rows, err := db.db.Query("SELECT login FROM users ORDER BY login")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var logins []string
+	for rows.Next() {
+		var login string
+		if err := rows.Scan(&login); err != nil {
+			return nil, err
+		}
+		logins = append(logins, login)
+	}
+	return logins, rows.Err()
+}
+
+// PasswordError describes why a password is too weak.
+type PasswordError string
+
+func (e PasswordError) Error() string {
+	return "weak password: " + string(e)
+}
+
+// checkPassword returns PasswordError if the password is shorter than
+// minLen characters, contains only one class of characters (such as
+// only letters or only digits) or is equal to the login.
+func checkPassword(login, password string, minLen int) error {
+	if n := utf8.RuneCountInString(password); n < minLen {
+		return PasswordError(fmt.Sprintf("at least %d characters required", minLen))
+	}
+	var letters, digits, others bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			letters = true
+		case unicode.IsDigit(r):
+			digits = true
+		default:
+			others = true
+		}
+	}
+	if password != "" && !(letters && digits || letters && others || digits && others) {
+		return PasswordError("use at least two of: letters, digits and other characters")
+	}
+	if password != "" && strings.EqualFold(password, login) {
+		return PasswordError("password must differ from the login")
+	}
+	return nil
+}
+
+// AuthenticateUser checks the password of the user.  After
+// db.maxFailures consecutive failed attempts the account is locked
+// for db.lockout (the password is not checked until then).  ErrAuth is
+// returned for unknown users, locked accounts and wrong passwords, in
+// similar time, so that neither the existence of logins nor the
+// correct password of a locked account is revealed.  For users with
+// two-factor authentication enabled VerifyTOTP must be called next.
+func (db *DB) AuthenticateUser(login string, password []byte) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var h []byte
+	var failed, lockedUntil int64
+	var secret string
+	err = tx.QueryRow("SELECT passwordhash, failed_attempts, locked_until, totp_secret FROM users WHERE login=?", login).Scan(&h, &failed, &lockedUntil, &secret)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			compareDummyHash(password)
+			return ErrAuth
+		}
+		return err
+	}
+	now := time.Now()
+	if lockedUntil < 0 || lockedUntil > now.Unix() {
+		compareDummyHash(password)
+		return ErrAuth
+	}
+	err = bcrypt.CompareHashAndPassword(h, password)
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return db.loginFailed(tx, login, failed, now)
+	} else if err != nil {
+		return err
+	}
+	// with two-factor authentication failed attempts are reset only
+	// after the code is verified (see VerifyTOTP)
+	if failed > 0 && secret == "" {
+		if _, err = tx.Exec("UPDATE users SET failed_attempts=0 WHERE login=?", login); err != nil {
 			return err
 		}
+	}
+	return tx.Commit()
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// compareDummyHash compares the password with a hash of a password no
+// user has so that rejecting unknown users and locked accounts takes
+// as long as checking a wrong password.
+func compareDummyHash(password []byte) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("pns dummy password"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, password)
+}
+
+// VerifyTOTP checks the TOTP code of the user (after the password is
+// checked with AuthenticateUser).  It returns nil for users without
+// two-factor authentication enabled and ErrTOTPRequired if the code is
+// empty.  Invalid codes (including already used ones) count as failed
+// login attempts.
+func (db *DB) VerifyTOTP(login, code string) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-		for _, s := range n.Topics {
-			_, err := tx.Exec("INSERT INTO tags (noteid, tagid) VALUES(?, ?)", noteid, m[s])
-			if err != nil {
-				return err
-			}
-		}
-		for _, s := range n.Tags {
-			_, err := tx.Exec("INSERT INTO tags (noteid, tagid) VALUES(?, ?)", noteid, m[s])
-			if err != nil {
-				return err
-			}
+	var failed, lockedUntil, lastStep int64
+	var secret string
+	err = tx.QueryRow("SELECT failed_attempts, locked_until, totp_secret, totp_step FROM users WHERE login=?", login).Scan(&failed, &lockedUntil, &secret, &lastStep)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrAuth
 		}
+		return err
+	}
+	if secret == "" {
+		return nil
+	}
+	now := time.Now()
+	if lockedUntil < 0 || lockedUntil > now.Unix() {
+		return ErrAuth
+	}
+	if code == "" {
+		return ErrTOTPRequired
+	}
+	step, ok := checkTOTP(secret, code, now, lastStep)
+	if !ok {
+		return db.loginFailed(tx, login, failed, now)
+	}
+	if _, err = tx.Exec("UPDATE users SET failed_attempts=0, totp_step=? WHERE login=?", step, login); err != nil {
+		return err
 	}
 	return tx.Commit()
 }
 
-func (db *DB) AddUser(login string, password []byte) error {
-	p, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+// loginFailed records failed login attempt (locking the account after
+// too many of them), commits the transaction and returns ErrAuth.
+func (db *DB) loginFailed(tx *sql.Tx, login string, failed int64, now time.Time) error {
+	var err error
+	failed++
+	if db.maxFailures > 0 && failed >= int64(db.maxFailures) {
+		_, err = tx.Exec("UPDATE users SET failed_attempts=0, locked_until=? WHERE login=?", now.Add(db.lockout), login)
+	} else {
+		_, err = tx.Exec("UPDATE users SET failed_attempts=? WHERE login=?", failed, login)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
 		return err
 	}
-	_, err = db.db.Exec("INSERT INTO users (login, passwordhash) VALUES (?, ?)", login, p)
+	return ErrAuth
+}
+
+// EnableTOTP enables two-factor authentication of the user and returns
+// the newly generated TOTP secret.
+func (db *DB) EnableTOTP(login string) (string, error) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	if err = db.setTOTPSecret(login, secret); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// DisableTOTP disables two-factor authentication of the user.
+func (db *DB) DisableTOTP(login string) error {
+	return db.setTOTPSecret(login, "")
+}
+
+func (db *DB) setTOTPSecret(login, secret string) error {
+	result, err := db.db.Exec("UPDATE users SET totp_secret=?, totp_step=0 WHERE login=?", secret, login)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err == nil && n == 0 {
+		err = ErrNoUser
+	}
 	return err
 }
 
-func (db *DB) AuthenticateUser(login string, password []byte) error {
-	var h []byte
-	if err := db.db.QueryRow("SELECT passwordhash FROM users WHERE login=?", login).Scan(&h); err != nil {
-		if err == sql.ErrNoRows {
-			return ErrAuth
-		}
+// UnlockUser unlocks the account locked after failed login attempts
+// (or disabled with DisableUser).
+func (db *DB) UnlockUser(login string) error {
+	return db.setLockedUntil(login, 0)
+}
+
+// DisableUser locks the account until unlocked with UnlockUser.
+// Sessions of the user are no longer accepted (see UserDisabled).
+func (db *DB) DisableUser(login string) error {
+	return db.setLockedUntil(login, -1)
+}
+
+// UserDisabled reports whether the account of the user is disabled
+// with DisableUser (or the user does not exist).
+func (db *DB) UserDisabled(login string) (bool, error) {
+	stmt, err := db.stmts.Stmt("SELECT locked_until FROM users WHERE login=?")
+	if err != nil {
+		return false, err
+	}
+	var lockedUntil int64
+	err = stmt.QueryRow(login).Scan(&lockedUntil)
+	if err == sql.ErrNoRows {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return lockedUntil < 0, nil
+}
+
+func (db *DB) setLockedUntil(login string, lockedUntil int64) error {
+	result, err := db.db.Exec("UPDATE users SET failed_attempts=0, locked_until=? WHERE login=?", lockedUntil, login)
+	if err != nil {
 		return err
 	}
-	err := bcrypt.CompareHashAndPassword(h, password)
-	if err == bcrypt.ErrMismatchedHashAndPassword {
-		return ErrAuth
+	n, err := result.RowsAffected()
+	if err == nil && n == 0 {
+		err = ErrNoUser
 	}
 	return err
 }
@@ -231,13 +964,13 @@ func (db *DB) AuthenticateUser(login string, password []byte) error {
 var topicsTemplate = template.Must(template.New("topics").Parse(topicsTemplateStr))
 
 const topicsTemplateStr = `
+<p><a href="{{$.Base}}/?when=today">{{.Today}}</a> · <a href="{{$.Base}}/?when=week">{{.Week}}</a></p>
+
 <h1>{{.Header}}</h1>
 
-<p>
-{{range .Tags}}
-<a href="{{.}}">{{.}}</a>
+{{range .Topics}}
+<div style="padding-left: {{.Depth}}em">{{if .URL}}<a href="{{$.Base}}{{.URL}}">{{.Name}}</a>{{else}}{{.Name}}{{end}}</div>
 {{end}}
-</p>
 `
 
 var tagsTemplate = template.Must(template.New("tags").Parse(tagsTemplateStr))
@@ -247,13 +980,22 @@ const tagsTemplateStr = `
 
 <p>
 {{range .Tags}}
-<a href="/-/{{.}}">{{.}}</a>
+<a href="{{$.Base}}/-/{{.}}">{{.}}</a>
 {{end}}
 </p>
 `
 
 func (db *DB) TopicsAndTags() ([]string, []string, error) {
-	return topicsAndTags(db.db, -1)
+	return db.tagCache.get(func() ([]string, []string, error) {
+		return topicsAndTags(db.stmts, -1)
+	})
+}
+
+// InvalidateTags drops the cached list of topics and tags so that it
+// is read again from the database. It is called whenever tag names
+// are added.
+func (db *DB) InvalidateTags() {
+	db.tagCache.invalidate()
 }
 
 func (s *server) TopicsAndTagsAsNotes() ([]*Note, []string, error) {
@@ -263,25 +1005,72 @@ func (s *server) TopicsAndTagsAsNotes() ([]*Note, []string, error) {
 	}
 	var bTopics, bTags bytes.Buffer
 	type data struct {
-		Header string
-		Tags   []string
+		Header, Base string
+		Tags         []string
 	}
-	if err = topicsTemplate.Execute(&bTopics, &data{s.tr("Topics"), topics}); err != nil {
+	type topicsData struct {
+		Header, Base, Today, Week string
+		Topics                    []topicNode
+	}
+	if err = topicsTemplate.Execute(&bTopics, &topicsData{s.tr("Topics"), s.base, s.tr("Created today"), s.tr("Created in the last 7 days"), topicTree(topics)}); err != nil {
 		return nil, nil, err
 	}
-	if err = tagsTemplate.Execute(&bTags, &data{s.tr("Tags"), tags}); err != nil {
+	if err = tagsTemplate.Execute(&bTags, &data{s.tr("Tags"), s.base, tags}); err != nil {
 		return nil, nil, err
 	}
 	notes := []*Note{
 		{Text: bTopics.String(), NoFooter: true},
 		{Text: bTags.String(), NoFooter: true},
 	}
-	return notes, append(topics, tags...), nil
+	return notes, concatTags(topics, tags), nil
 }
 
 // NewTags for given list of tags and topics returns those that are
 // not found in the database.
 func (db *DB) NewTags(tags []string) ([]string, error) {
+	m, err := db.existingTags(tags)
+	if err != nil {
+		return nil, err
+	}
+	var newTags []string
+	for _, tag := range tags {
+		if _, present := m[tag]; !present {
+			newTags = append(newTags, tag)
+		}
+	}
+	sort.Strings(newTags)
+	return newTags, nil
+}
+
+// CollidingTags for given list of tags and topics returns existing
+// tags and topics differing from them only by the leading "/" (i.e.,
+// existing topic "/work" for tag "work" and vice versa).
+func (db *DB) CollidingTags(tags []string) ([]string, error) {
+	counterparts := make([]string, len(tags))
+	for i, tag := range tags {
+		if strings.HasPrefix(tag, "/") {
+			counterparts[i] = tag[1:]
+		} else {
+			counterparts[i] = "/" + tag
+		}
+	}
+	m, err := db.existingTags(counterparts)
+	if err != nil {
+		return nil, err
+	}
+	var colliding []string
+	for _, tag := range counterparts {
+		if _, present := m[tag]; present {
+			colliding = append(colliding, tag)
+		}
+	}
+	sort.Strings(colliding)
+	return colliding, nil
+}
+
+// existingTags returns the set of those of given tags and topics
+// which are found in the database.
+func (db *DB) existingTags(tags []string) (map[string]struct{}, error) {
 	// select rowid, * from tagnames where name in ("db", "todo", "spec");
 	query := fmt.Sprintf("SELECT name FROM tagnames WHERE name IN (%s)", questionMarks(len(tags)))
 	rows, err := db.db.Query(query, stringsAsEmptyInterface(tags)...)
@@ -298,14 +1087,7 @@ func (db *DB) NewTags(tags []string) ([]string, error) {
 		}
 		m[name] = struct{}{}
 	}
-	var newTags []string
-	for _, tag := range tags {
-		if _, present := m[tag]; !present {
-			newTags = append(newTags, tag)
-		}
-	}
-	sort.Strings(newTags)
-	return newTags, nil
+	return m, rows.Err()
 }
 
 func stringsAsEmptyInterface(input []string) (output []interface{}) {
@@ -322,45 +1104,65 @@ func int64sAsEmptyInterface(input []int64) (output []interface{}) {
 	return
 }
 
-// Note returns note with the given ID
+// Note returns note with the given ID (notes in the trash are not
+// found).
 func (db *DB) Note(id int64) (*Note, error) {
+	return db.NoteContext(context.Background(), id)
+}
+
+// NoteContext is like Note but it stops reading rows when the
+// context is done.
+func (db *DB) NoteContext(ctx context.Context, id int64) (*Note, error) {
 	var note string
-	var created, modified int64
-	err := db.db.QueryRow("SELECT note, created, modified FROM notes WHERE rowid=?", id).Scan(&note, &created, &modified)
+	var created, modified, copiedFrom int64
+	stmt, err := db.stmts.Stmt("SELECT note, created, modified, copied_from FROM notes WHERE rowid=? AND deleted_at=0")
 	if err != nil {
 		return nil, err
 	}
-	topics, tags, err := topicsAndTags(db.db, id)
+	err = stmt.QueryRowContext(ctx, id).Scan(&note, &created, &modified, &copiedFrom)
 	if err != nil {
 		return nil, err
 	}
-	return &Note{ID: id, Text: note, Created: time.Unix(created, 0), Modified: time.Unix(modified, 0),
-		Topics: topics, Tags: tags}, nil
+	topics, tags, err := topicsAndTags(db.stmts.WithContext(ctx), id)
+	if err != nil {
+		return nil, err
+	}
+	return &Note{ID: id, Text: note, Created: unixTime(created), Modified: unixTime(modified),
+		Topics: topics, Tags: tags, CopiedFrom: copiedFrom}, nil
 }
 
 func (db *DB) AllNotes() (notes []*Note, err error) {
+	defer db.logSlowQuery(time.Now(), "all notes")
 	tx, err := db.db.Begin()
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback()
 
-	rows, err := tx.Query("SELECT rowid, note, created, modified FROM notes ORDER BY rowid")
+	notes, err = allNotes(tx)
 	if err != nil {
 		return nil, err
 	}
-	notes, err = notesFromRowsClose(rows)
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return notes, nil
+
+}
+
+func allNotes(tx Querier) ([]*Note, error) {
+	rows, err := tx.Query("SELECT rowid, note, created, modified, copied_from FROM notes WHERE deleted_at=0 ORDER BY rowid")
 	if err != nil {
 		return nil, err
 	}
-	for _, n := range notes {
-		n.Topics, n.Tags, err = topicsAndTags(tx, n.ID)
+	notes, err := notesFromRowsClose(rows)
+	if err != nil {
+		return nil, err
 	}
-	if err = tx.Commit(); err != nil {
+	if err = setTopicsAndTags(tx, notes); err != nil {
 		return nil, err
 	}
 	return notes, nil
-
 }
 
 const notesQueryFormat = `
@@ -368,19 +1170,22 @@ SELECT
 	n.rowid,
 	n.note,
 	n.created,
-	n.modified
+	n.modified,
+	n.copied_from
 FROM
 	notes AS n
 INNER JOIN
 	tags AS t
 ON
 	n.rowid = t.noteid
+AND
+	n.deleted_at = 0
 AND
 	t.tagid in (%s)
+%s
 GROUP BY
 	n.rowid
-HAVING
-	COUNT(n.rowid)=?
+%s
 ORDER BY
 	%s
 `
@@ -390,57 +1195,128 @@ SELECT
 	n.rowid,
 	n.note,
 	n.created,
-	n.modified
+	n.modified,
+	n.copied_from
 FROM
 	notes AS n
 INNER JOIN
 	tags AS t
 ON
 	n.rowid = t.noteid
+AND
+	n.deleted_at = 0
 AND
 	t.tagid in (%s)
+%s
 AND
 	n.rowid in (SELECT rowid FROM ftsnotes WHERE note MATCH ?)
 GROUP BY
 	n.rowid
-HAVING
-	COUNT(n.rowid)=?
+%s
 ORDER BY
 	%s
 `
 
-func (db *DB) Notes(topic string, tags []string, fts string, start int, orderedByCreated bool) (notes []*Note, err error) {
-	tx, err := db.db.Begin()
+// noteOrder is the order of notes returned by Notes.
+type noteOrder int
+
+const (
+	orderByID         noteOrder = iota // all notes (not limited to queryLimit+1)
+	orderByCreated                     // oldest first
+	orderByLastViewed                  // least recently viewed first
+	orderByRelevance                   // best full text search matches first
+)
+
+// Notes returns notes with the given topic (unless it is "/-") and
+// tags. If anyTag is true notes having any of the given tags (and the
+// given topic) are returned instead of notes having all the tags.
+// Notes having any of the exclude topics or tags are not returned.
+func (db *DB) Notes(topic string, tags []string, fts string, start int, order noteOrder, anyTag bool, exclude []string) (notes []*Note, err error) {
+	return db.NotesContext(context.Background(), topic, tags, fts, start, order, anyTag, exclude)
+}
+
+// NotesContext is like Notes but the query is interrupted when the
+// context is done.
+//
+// Listings ordered by creation time use notesCreated index: for
+// topics and tags matching a large part of the notes SQLite may scan
+// notes in the order of the index (stopping after LIMIT rows) instead
+// of sorting all the matching notes (EXPLAIN QUERY PLAN then shows no
+// "USE TEMP B-TREE FOR ORDER BY"), for rare tags the join through
+// tagsTagId index is still used.
+func (db *DB) NotesContext(ctx context.Context, topic string, tags []string, fts string, start int, order noteOrder, anyTag bool, exclude []string) (notes []*Note, err error) {
+	defer db.logSlowQuery(time.Now(), "notes topic=%q tags=%q fts=%q start=%d any=%v exclude=%q", topic, tags, fts, start, anyTag, exclude)
+	tx, done, err := db.beginContext(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer done()
 	defer tx.Rollback()
 
-	if topic != "/-" || len(tags) == 0 {
+	withTopic := topic != "/-" || len(tags) == 0
+	anyTag = anyTag && len(tags) > 0
+	if withTopic {
 		tags = append(tags, topic)
 	}
 	tagIDs, err := db.tagIDs(tx, tags)
 	if err != nil {
 		return nil, err
 	}
+	var (
+		excluding  string
+		excludeIDs []interface{}
+	)
+	if len(exclude) > 0 {
+		excludeIDs, err = db.tagIDs(tx, exclude)
+		if e, ok := err.(NoTagsError); ok {
+			// unknown tags exclude nothing
+			if known := without(exclude, e); len(known) > 0 {
+				excludeIDs, err = db.tagIDs(tx, known)
+			} else {
+				excludeIDs, err = nil, nil
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(excludeIDs) > 0 {
+		excluding = fmt.Sprintf("AND\n\tn.rowid NOT IN (SELECT noteid FROM tags WHERE tagid IN (%s))", questionMarks(len(excludeIDs)))
+	}
 	var orderedBy string
-	if orderedByCreated {
-		orderedBy = fmt.Sprintf("n.created asc LIMIT %d OFFSET %d", queryLimit+1, start)
-	} else {
+	switch order {
+	case orderByCreated:
+		orderedBy = fmt.Sprintf("n.created asc, n.rowid asc LIMIT %d OFFSET %d", queryLimit+1, start)
+	case orderByLastViewed:
+		orderedBy = fmt.Sprintf("n.last_viewed asc, n.rowid asc LIMIT %d OFFSET %d", queryLimit+1, start)
+	default:
 		orderedBy = "n.rowid asc"
 	}
 	var (
-		query string
-		args  []interface{}
+		query      string
+		args       []interface{}
+		having     string
+		havingArgs []interface{}
 	)
+	switch {
+	case anyTag && withTopic:
+		having = "HAVING SUM(t.tagid=(SELECT rowid FROM tagnames WHERE name=?))>0 AND COUNT(n.rowid)>1"
+		havingArgs = []interface{}{topic}
+	case anyTag:
+		// GROUP BY alone removes duplicates
+	default:
+		having = "HAVING COUNT(n.rowid)=?"
+		havingArgs = []interface{}{len(tagIDs)}
+	}
+	args = append(tagIDs, excludeIDs...)
 	if fts != "" {
-		query = fmt.Sprintf(notesQueryWithFtsFormat, questionMarks(len(tagIDs)), orderedBy)
-		args = append(tagIDs, fts, len(tagIDs))
+		query = fmt.Sprintf(notesQueryWithFtsFormat, questionMarks(len(tagIDs)), excluding, having, orderedBy)
+		args = append(args, fts)
 	} else {
-		query = fmt.Sprintf(notesQueryFormat, questionMarks(len(tagIDs)), orderedBy)
-		args = append(tagIDs, len(tagIDs))
+		query = fmt.Sprintf(notesQueryFormat, questionMarks(len(tagIDs)), excluding, having, orderedBy)
 	}
-	rows, err := tx.Query(query, args...)
+	args = append(args, havingArgs...)
+	rows, err := tx.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -448,48 +1324,278 @@ func (db *DB) Notes(topic string, tags []string, fts string, start int, orderedB
 	if err != nil {
 		return nil, err
 	}
-	for _, n := range notes {
-		n.Topics, n.Tags, err = topicsAndTags(tx, n.ID)
+	if err = setTopicsAndTags(tx, notes); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return notes, nil
+
+}
+
+// RecentNotes returns at most limit notes, most recently modified
+// first.
+func (db *DB) RecentNotes(limit int) ([]*Note, error) {
+	return db.RecentNotesContext(context.Background(), limit)
+}
+
+// RecentNotesContext is like RecentNotes but the query is interrupted
+// when the context is done.
+func (db *DB) RecentNotesContext(ctx context.Context, limit int) ([]*Note, error) {
+	tx, done, err := db.beginContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, "SELECT rowid, note, created, modified, copied_from FROM notes WHERE deleted_at=0 ORDER BY modified DESC, rowid DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	notes, err := notesFromRowsClose(rows)
+	if err != nil {
+		return nil, err
+	}
+	if err = setTopicsAndTags(tx, notes); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+// NotesCreatedSince returns at most queryLimit+1 notes (not in the
+// trash) created at or after since starting from start, oldest first.
+func (db *DB) NotesCreatedSince(since time.Time, start int) ([]*Note, error) {
+	return db.NotesCreatedSinceContext(context.Background(), since, start)
+}
+
+// NotesCreatedSinceContext is like NotesCreatedSince but the query is
+// interrupted when the context is done.
+func (db *DB) NotesCreatedSinceContext(ctx context.Context, since time.Time, start int) ([]*Note, error) {
+	defer db.logSlowQuery(time.Now(), "notes since=%v start=%d", since, start)
+	tx, done, err := db.beginContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, "SELECT rowid, note, created, modified, copied_from FROM notes WHERE deleted_at=0 AND created>=? ORDER BY created, rowid LIMIT ? OFFSET ?", since, queryLimit+1, start)
+	if err != nil {
+		return nil, err
+	}
+	notes, err := notesFromRowsClose(rows)
+	if err != nil {
+		return nil, err
+	}
+	if err = setTopicsAndTags(tx, notes); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+// ActivityByDay returns the number of notes (not in the trash) created
+// from from (inclusive) to to (exclusive) by day (formatted such as
+// 2006-01-02 in the time zone of the dates shown). Days without notes
+// are omitted.
+func (db *DB) ActivityByDay(from, to time.Time) (map[string]int, error) {
+	return db.ActivityByDayContext(context.Background(), from, to)
+}
+
+// ActivityByDayContext is like ActivityByDay but it stops reading
+// rows when the context is done.
+func (db *DB) ActivityByDayContext(ctx context.Context, from, to time.Time) (map[string]int, error) {
+	rows, err := db.db.QueryContext(ctx, "SELECT created FROM notes WHERE deleted_at=0 AND created>=? AND created<?", from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	days := make(map[string]int)
+	for rows.Next() {
+		var created int64
+		if err := rows.Scan(&created); err != nil {
+			return nil, err
+		}
+		days[unixTime(created).Format("2006-01-02")]++
+	}
+	return days, rows.Err()
+}
+
+// NotesByIDRange returns notes (not in the trash) with IDs from minID
+// to maxID (inclusive) ordered by ID.
+func (db *DB) NotesByIDRange(minID, maxID int64) ([]*Note, error) {
+	return db.NotesByIDRangeContext(context.Background(), minID, maxID)
+}
+
+// NotesByIDRangeContext is like NotesByIDRange but the query is
+// interrupted when the context is done.
+func (db *DB) NotesByIDRangeContext(ctx context.Context, minID, maxID int64) ([]*Note, error) {
+	tx, done, err := db.beginContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, "SELECT rowid, note, created, modified, copied_from FROM notes WHERE deleted_at=0 AND rowid BETWEEN ? AND ? ORDER BY rowid", minID, maxID)
+	if err != nil {
+		return nil, err
+	}
+	notes, err := notesFromRowsClose(rows)
+	if err != nil {
+		return nil, err
+	}
+	if err = setTopicsAndTags(tx, notes); err != nil {
+		return nil, err
 	}
 	if err = tx.Commit(); err != nil {
 		return nil, err
 	}
 	return notes, nil
+}
+
+// logSlowQuery logs the description of a query started at the given
+// time if it took longer than db.slowQuery.  It is intended to be
+// deferred at the start of a query.
+func (db *DB) logSlowQuery(start time.Time, format string, args ...interface{}) {
+	if d := time.Since(start); db.slowQuery > 0 && d > db.slowQuery {
+		log.Printf("slow query (%v): "+format, append([]interface{}{d}, args...)...)
+	}
+}
+
+// SetViewed records that the note was viewed now (see
+// orderByLastViewed).
+func (db *DB) SetViewed(id int64) error {
+	_, err := db.db.Exec("UPDATE notes SET last_viewed=? WHERE rowid=?", time.Now(), id)
+	return err
+}
+
+// SyncCursor returns the highest note ID and the latest time a note
+// was modified (or moved to or from the trash, or the notes changed
+// otherwise, see LastChange) so that a client may detect changes.
+func (db *DB) SyncCursor() (maxID int64, latestModified time.Time, err error) {
+	var id, modified sql.NullInt64
+	err = db.db.QueryRow("SELECT MAX(rowid), MAX(MAX(modified), MAX(deleted_at)) FROM notes").Scan(&id, &modified)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	latestModified = unixTime(modified.Int64)
+	changed, err := db.LastChange()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if changed.After(latestModified) {
+		latestModified = changed
+	}
+	return id.Int64, latestModified, nil
+}
+
+// touch records the time of a change not reflected in the modification
+// times of the notes (such as restoring or removing notes or adding
+// notes modified earlier) so that listings cached by the browsers are
+// not considered fresh and sync clients see the change (see
+// LastChange and SyncCursor).
+func touch(tx *sql.Tx) error {
+	_, err := tx.Exec("INSERT OR REPLACE INTO pns (key, value) VALUES ('last_change', ?)", strconv.FormatInt(time.Now().Unix(), 10))
+	return err
+}
 
+// LastChange returns the time recorded with touch (zero time if none).
+func (db *DB) LastChange() (time.Time, error) {
+	var value string
+	err := db.db.QueryRow("SELECT value FROM pns WHERE key='last_change'").Scan(&value)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	sec, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error parsing last_change: %v", err)
+	}
+	return unixTime(sec), nil
 }
 
-const ftsQueryFormat = `
+const ftsQuery = `
 SELECT
-	rowid, note, created, modified
+	rowid, note, created, modified, copied_from
 FROM
 	notes
 WHERE
+        deleted_at = 0
+AND
         rowid in (SELECT rowid FROM ftsnotes WHERE note MATCH ?)
 ORDER BY
-        created
+        created, rowid
 LIMIT
-	%d
+	?
 OFFSET
-	%d
+	?
+`
+
+// ftsRankQuery matches the whole ftsnotes table so that matchinfo
+// reports hits in the title column as well, the notes are selected by
+// matching the note column as in ftsQuery.
+const ftsRankQuery = `
+SELECT
+	ftsnotes.docid, notes.created, matchinfo(ftsnotes, 'pcnx')
+FROM
+	ftsnotes
+INNER JOIN
+	notes
+ON
+	notes.rowid = ftsnotes.docid
+WHERE
+	ftsnotes MATCH ?
+AND
+	ftsnotes.docid IN (SELECT docid FROM ftsnotes WHERE note MATCH ?)
+AND
+	notes.deleted_at = 0
 `
 
+// FTS returns notes matching the full text search query, the oldest
+// first.
 func (db *DB) FTS(q string, start int) ([]*Note, error) {
-	tx, err := db.db.Begin()
+	return db.FTSContext(context.Background(), q, start, orderByCreated)
+}
+
+// FTSContext is like FTS but the query is interrupted when the
+// context is done. The order is either orderByCreated or orderByRelevance.
+func (db *DB) FTSContext(ctx context.Context, q string, start int, order noteOrder) ([]*Note, error) {
+	defer db.logSlowQuery(time.Now(), "fts q=%q start=%d order=%d", q, start, order)
+	tx, done, err := db.beginContext(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer done()
 	defer tx.Rollback()
 
-	rows, err := tx.Query(fmt.Sprintf(ftsQueryFormat, queryLimit+1, start), q)
-	if err != nil {
-		return nil, err
+	var notes []*Note
+	if order == orderByRelevance {
+		notes, err = rankedFTS(ctx, tx, q, start)
+	} else {
+		var stmt *sql.Stmt
+		var rows *sql.Rows
+		stmt, err = db.stmts.Stmt(ftsQuery)
+		if err == nil {
+			rows, err = tx.StmtContext(ctx, stmt).QueryContext(ctx, q, queryLimit+1, start)
+		}
+		if err == nil {
+			notes, err = notesFromRowsClose(rows)
+		}
 	}
-	notes, err := notesFromRowsClose(rows)
 	if err != nil {
 		return nil, err
 	}
-	for _, n := range notes {
-		n.Topics, n.Tags, err = topicsAndTags(tx, n.ID)
+	if err = setTopicsAndTags(tx, notes); err != nil {
+		return nil, err
 	}
 	if err = tx.Commit(); err != nil {
 		return nil, err
@@ -497,7 +1603,13 @@ func (db *DB) FTS(q string, start int) ([]*Note, error) {
 	return notes, nil
 }
 
-func (db *DB) tagIDs(tx *sql.Tx, tags []string) ([]interface{}, error) {
+// TagIDs returns IDs of the given tags (and topics). NoTagsError is
+// returned if some of the tags are not found.
+func (db *DB) TagIDs(tags []string) ([]interface{}, error) {
+	return db.tagIDs(db.db, tags)
+}
+
+func (db *DB) tagIDs(tx Querier, tags []string) ([]interface{}, error) {
 	m := make(map[string]bool)
 	for _, tag := range tags {
 		m[tag] = false
@@ -541,17 +1653,74 @@ func (db *DB) tagIDs(tx *sql.Tx, tags []string) ([]interface{}, error) {
 	return ids, nil
 }
 
+// rankedFTS returns at most queryLimit+1 notes matching the full text
+// search query starting from start, the best matches first. As FTS4
+// cannot order by relevance all the matching notes are ranked (see
+// relevance).
+func rankedFTS(ctx context.Context, tx *sql.Tx, q string, start int) ([]*Note, error) {
+	rows, err := tx.QueryContext(ctx, ftsRankQuery, q, q)
+	if err != nil {
+		return nil, err
+	}
+	var ranked []rankedNote
+	for rows.Next() {
+		var r rankedNote
+		var matchinfo []byte
+		if err = rows.Scan(&r.id, &r.created, &matchinfo); err == nil {
+			r.score, err = relevance(matchinfo)
+		}
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ranked = append(ranked, r)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Sort(byRelevance(ranked))
+	if start >= len(ranked) {
+		return nil, nil
+	}
+	ranked = ranked[start:]
+	if len(ranked) > queryLimit+1 {
+		ranked = ranked[:queryLimit+1]
+	}
+
+	ids := make([]interface{}, len(ranked))
+	pos := make(map[int64]int)
+	for i, r := range ranked {
+		ids[i] = r.id
+		pos[r.id] = i
+	}
+	rows, err = tx.QueryContext(ctx, fmt.Sprintf("SELECT rowid, note, created, modified, copied_from FROM notes WHERE rowid IN (%s)", questionMarks(len(ids))), ids...)
+	if err != nil {
+		return nil, err
+	}
+	notes, err := notesFromRowsClose(rows)
+	if err != nil {
+		return nil, err
+	}
+	sorted := make([]*Note, len(ranked))
+	for _, n := range notes {
+		sorted[pos[n.ID]] = n
+	}
+	return sorted, nil
+}
+
 func notesFromRowsClose(rows *sql.Rows) ([]*Note, error) {
 	defer rows.Close()
 
 	var notes []*Note
 	for rows.Next() {
 		var note string
-		var rowid, created, modified int64
-		if err := rows.Scan(&rowid, &note, &created, &modified); err != nil {
+		var rowid, created, modified, copiedFrom int64
+		if err := rows.Scan(&rowid, &note, &created, &modified, &copiedFrom); err != nil {
 			return nil, err
 		}
-		notes = append(notes, &Note{ID: rowid, Text: note, Created: time.Unix(created, 0), Modified: time.Unix(modified, 0)})
+		notes = append(notes, &Note{ID: rowid, Text: note, Created: unixTime(created), Modified: unixTime(modified),
+			CopiedFrom: copiedFrom})
 
 	}
 	if err := rows.Err(); err != nil {
@@ -586,11 +1755,146 @@ func topicsAndTags(tx Querier, noteID int64) (topics, tags []string, err error)
 	if err := rows.Err(); err != nil {
 		return nil, nil, err
 	}
-	sort.Strings(topics)
+	sort.Sort(topicsByLevel(topics))
 	sort.Strings(tags)
 	return
 }
 
+// tagsBatchSize limits the number of note ids bound in a single query
+// by topicsAndTagsForNotes.
+const tagsBatchSize = 500
+
+// topicsAndTagsForNotes returns sorted topics and tags of the given
+// notes keyed by note id, fetching them in as few queries as possible.
+func topicsAndTagsForNotes(tx Querier, ids []int64) (map[int64][]string, map[int64][]string, error) {
+	topics := make(map[int64][]string)
+	tags := make(map[int64][]string)
+	for len(ids) > 0 {
+		batch := ids
+		if len(batch) > tagsBatchSize {
+			batch = batch[:tagsBatchSize]
+		}
+		ids = ids[len(batch):]
+		if err := queryTopicsAndTags(tx, batch, topics, tags); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, t := range topics {
+		sort.Sort(topicsByLevel(t))
+	}
+	for _, t := range tags {
+		sort.Strings(t)
+	}
+	return topics, tags, nil
+}
+
+func queryTopicsAndTags(tx Querier, ids []int64, topics, tags map[int64][]string) error {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := tx.Query(fmt.Sprintf(topicsAndTagsForNotesQueryFormat, questionMarks(len(ids))), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var tag string
+		if err := rows.Scan(&id, &tag); err != nil {
+			return err
+		}
+		if len(tag) > 0 && tag[0] == '/' {
+			topics[id] = append(topics[id], tag)
+		} else {
+			tags[id] = append(tags[id], tag)
+		}
+	}
+	return rows.Err()
+}
+
+// setTopicsAndTags fills in topics and tags of the given notes.
+func setTopicsAndTags(tx Querier, notes []*Note) error {
+	ids := make([]int64, len(notes))
+	for i, n := range notes {
+		ids[i] = n.ID
+	}
+	topics, tags, err := topicsAndTagsForNotes(tx, ids)
+	if err != nil {
+		return err
+	}
+	for _, n := range notes {
+		n.Topics, n.Tags = topics[n.ID], tags[n.ID]
+	}
+	return nil
+}
+
+// topicsByLevel sorts multi-level topics (such as "/work/project") so
+// that every topic is directly followed by its descendants.
+type topicsByLevel []string
+
+func (t topicsByLevel) Len() int      { return len(t) }
+func (t topicsByLevel) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+
+func (t topicsByLevel) Less(i, j int) bool {
+	a, b := strings.Split(t[i], "/"), strings.Split(t[j], "/")
+	for k := 0; k < len(a) && k < len(b); k++ {
+		if a[k] != b[k] {
+			return a[k] < b[k]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// descendantTopics returns those of the topics (sorted by level) which
+// are below the given topic in the topic hierarchy.
+func descendantTopics(topics []string, topic string) []string {
+	var descendants []string
+	for _, t := range topics {
+		if strings.HasPrefix(t, topic+"/") {
+			descendants = append(descendants, t)
+		}
+	}
+	return descendants
+}
+
+type topicNode struct {
+	Name  string
+	URL   string // empty if there is no such topic (only its descendants)
+	Depth int
+}
+
+// topicTree returns topics (sorted by level) as nodes of the topic
+// hierarchy in depth-first order, including intermediate levels which
+// are not topics themselves.
+func topicTree(topics []string) []topicNode {
+	var (
+		nodes []topicNode
+		last  []string
+	)
+	for _, topic := range topics {
+		levels := strings.Split(topic[1:], "/")
+		common := 0
+		for common < len(levels)-1 && common < len(last) && levels[common] == last[common] {
+			common++
+		}
+		for i := common; i < len(levels); i++ {
+			name := levels[i]
+			if i == 0 {
+				name = "/" + name
+			}
+			link := ""
+			if i == len(levels)-1 {
+				link = topicPath(topic)
+			}
+			nodes = append(nodes, topicNode{name, link, i})
+		}
+		last = levels
+	}
+	return nodes
+}
+
 const topicsAndTagsQuery = `
 SELECT
 	n.name
@@ -604,6 +1908,81 @@ AND
 	t.tagid = n.rowid
 `
 
+const topicsAndTagsForNotesQueryFormat = `
+SELECT
+	t.noteid, n.name
+FROM
+	tags AS t
+INNER JOIN
+	tagnames AS n
+ON
+	t.noteid IN (%s)
+AND
+	t.tagid = n.rowid
+`
+
+const relatedTagsQueryFormat = `
+SELECT
+	n.name
+FROM
+	tags AS t
+INNER JOIN
+	tagnames AS n
+ON
+	t.tagid = n.rowid
+WHERE
+	t.noteid IN (SELECT noteid FROM tags WHERE tagid IN (%s) GROUP BY noteid HAVING COUNT(noteid)=?)
+AND
+	t.noteid IN (SELECT rowid FROM notes WHERE deleted_at=0)
+AND
+	t.tagid NOT IN (%s)
+GROUP BY
+	t.tagid
+ORDER BY
+	COUNT(t.noteid) DESC, n.name
+LIMIT
+	?
+`
+
+// RelatedTags returns at most limit tags (and topics) which most
+// frequently occur on notes having all the tags with given IDs
+// (excluding those tags).
+func (db *DB) RelatedTags(tagIDs []interface{}, limit int) ([]string, error) {
+	return db.RelatedTagsContext(context.Background(), tagIDs, limit)
+}
+
+// RelatedTagsContext is like RelatedTags but it stops reading rows
+// when the context is done.
+func (db *DB) RelatedTagsContext(ctx context.Context, tagIDs []interface{}, limit int) ([]string, error) {
+	if len(tagIDs) == 0 {
+		return nil, nil
+	}
+	q := questionMarks(len(tagIDs))
+	args := make([]interface{}, 0, 2*len(tagIDs)+2)
+	args = append(args, tagIDs...)
+	args = append(args, len(tagIDs))
+	args = append(args, tagIDs...)
+	args = append(args, limit)
+	rows, err := db.db.QueryContext(ctx, fmt.Sprintf(relatedTagsQueryFormat, q, q), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
 // tagsToIDsMayInsert returns slice of tag IDs corresponding to given
 // tag (and topic) names. Those tag names which are not in the
 // database are inserted into tagnames table and such obtained tag IDs
@@ -665,8 +2044,12 @@ func (db *DB) updateNote(noteID int64, text string, tags []string, sha1sum strin
 		return err
 	}
 	defer tx.Rollback()
+	defer db.InvalidateTags()
 
 	// 0. Check sha1sum matches db record
+	if db.maxNoteSize > 0 && len(text) > db.maxNoteSize {
+		return ErrNoteTooLong
+	}
 	note, err := db.Note(noteID)
 	if err != nil {
 		return err
@@ -678,12 +2061,12 @@ func (db *DB) updateNote(noteID int64, text string, tags []string, sha1sum strin
 	}
 
 	// 1. Update note.
-	now := time.Now()
+	now := time.Now().In(location)
 	_, err = tx.Exec("UPDATE notes SET note=?, modified=? where rowid=?", text, now, noteID)
 	if err != nil {
 		return err
 	}
-	_, err = tx.Exec("UPDATE ftsnotes SET note=? WHERE rowid=?", text, noteID)
+	_, err = tx.Exec("UPDATE ftsnotes SET note=?, title=? WHERE rowid=?", text, noteTitle(text), noteID)
 	if err != nil {
 		return err
 	}
@@ -737,10 +2120,7 @@ func (db *DB) updateNote(noteID int64, text string, tags []string, sha1sum strin
 
 	// 5. save to git
 	if db.git != nil {
-		var b bytes.Buffer
-		sort.Strings(tags)
-		fmt.Fprintf(&b, "%s\n%s\n\n%s", strings.Join(tags, " "), note.Created.Format(timeLayout), text)
-		if err = db.git.Add(idToGitName(noteID), b.Bytes()); err != nil {
+		if err = db.git.Add(idToGitName(noteID), gitBlob(tags, note.Created, text)); err != nil {
 			return err
 		}
 		if err = db.git.Commit(strconv.FormatInt(noteID, 10), now); err != nil {
@@ -748,19 +2128,31 @@ func (db *DB) updateNote(noteID int64, text string, tags []string, sha1sum strin
 		}
 	}
 
-	return tx.Commit()
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	db.publish(noteID, "update")
+	return nil
 }
 
-func (db *DB) addNote(text string, tags []string) (noteID int64, err error) {
+// addNote adds a new note. If copiedFrom is positive it is the ID of
+// the note of which the new note is a copy.
+func (db *DB) addNote(text string, tags []string, copiedFrom int64) (noteID int64, err error) {
 	tx, err := db.db.Begin()
 	if err != nil {
 		return 0, err
 	}
 	defer tx.Rollback()
+	defer db.InvalidateTags()
+
+	// 0. Check quotas
+	if err = db.checkQuota(tx, text); err != nil {
+		return 0, err
+	}
 
 	// 1. Update note.
-	now := time.Now()
-	result, err := tx.Exec("INSERT INTO notes (note, created, modified) VALUES (?, ?, ?)", text, now, now)
+	now := time.Now().In(location)
+	result, err := tx.Exec("INSERT INTO notes (note, created, modified, copied_from) VALUES (?, ?, ?, ?)", text, now, now, copiedFrom)
 	if err != nil {
 		return 0, err
 	}
@@ -768,7 +2160,7 @@ func (db *DB) addNote(text string, tags []string) (noteID int64, err error) {
 	if err != nil {
 		return 0, err
 	}
-	_, err = tx.Exec("INSERT INTO ftsnotes (docid, note) VALUES (?, ?)", noteID, text)
+	_, err = tx.Exec("INSERT INTO ftsnotes (docid, note, title) VALUES (?, ?, ?)", noteID, text, noteTitle(text))
 	if err != nil {
 		return 0, err
 	}
@@ -792,10 +2184,7 @@ func (db *DB) addNote(text string, tags []string) (noteID int64, err error) {
 
 	// 4. save to git
 	if db.git != nil {
-		var b bytes.Buffer
-		sort.Strings(tags)
-		fmt.Fprintf(&b, "%s\n%s\n\n%s", strings.Join(tags, " "), now.Format(timeLayout), text)
-		if err = db.git.Add(idToGitName(noteID), b.Bytes()); err != nil {
+		if err = db.git.Add(idToGitName(noteID), gitBlob(tags, now, text)); err != nil {
 			return 0, err
 		}
 		if err = db.git.Commit(strconv.FormatInt(noteID, 10), now); err != nil {
@@ -806,9 +2195,154 @@ func (db *DB) addNote(text string, tags []string) (noteID int64, err error) {
 	if err = tx.Commit(); err != nil {
 		return 0, err
 	}
+	db.publish(noteID, "add")
 	return
 }
 
+// DeleteNote moves the note with the given ID to the trash. Notes in
+// the trash are not shown in listings and search results.
+func (db *DB) DeleteNote(id int64) error {
+	err := db.setDeletedAt(id, time.Now(), "deleted_at=0")
+	if err == nil {
+		db.publish(id, "delete")
+	}
+	return err
+}
+
+// RestoreNote moves the note with the given ID back from the trash.
+func (db *DB) RestoreNote(id int64) error {
+	err := db.setDeletedAt(id, 0, "deleted_at>0")
+	if err == nil {
+		db.publish(id, "restore")
+	}
+	return err
+}
+
+// publish passes the event of the note with the given ID to the event
+// stream subscribers (if events are enabled).
+func (db *DB) publish(id int64, typ string) {
+	if db.events != nil {
+		db.events.Publish(NoteEvent{id, typ, 0})
+	}
+}
+
+func (db *DB) setDeletedAt(id int64, deletedAt interface{}, cond string) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE notes SET deleted_at=? WHERE rowid=? AND "+cond, deletedAt, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	// restoring does not change the modification time of the note
+	if err = touch(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// TrashNotes returns notes in the trash, most recently deleted first.
+func (db *DB) TrashNotes() ([]*Note, error) {
+	return db.TrashNotesContext(context.Background())
+}
+
+// TrashNotesContext is like TrashNotes but the query is interrupted
+// when the context is done.
+func (db *DB) TrashNotesContext(ctx context.Context) ([]*Note, error) {
+	tx, done, err := db.beginContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, "SELECT rowid, note, created, modified, copied_from FROM notes WHERE deleted_at>0 ORDER BY deleted_at DESC, rowid DESC")
+	if err != nil {
+		return nil, err
+	}
+	notes, err := notesFromRowsClose(rows)
+	if err != nil {
+		return nil, err
+	}
+	if err = setTopicsAndTags(tx, notes); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+// EmptyTrash permanently removes notes moved to the trash before the
+// given time and returns the number of removed notes. Removal of
+// each note is also commited to git (if used).
+func (db *DB) EmptyTrash(before time.Time) (int, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT rowid FROM notes WHERE deleted_at>0 AND deleted_at<?", before)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		_, err = tx.Exec("DELETE FROM tags WHERE noteid=?", id)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM ftsnotes WHERE docid=?", id)
+		}
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM notes WHERE rowid=?", id)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if db.git != nil {
+			if err = db.git.Remove(idToGitName(id)); err != nil {
+				return 0, err
+			}
+			if err = db.git.Commit("delete "+strconv.FormatInt(id, 10), time.Now()); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if len(ids) > 0 {
+		if err = touch(tx); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
+
 type MultiError []error
 
 func (me MultiError) Error() string {
@@ -825,6 +2359,65 @@ func (e NoTagsError) Error() string {
 	return "no such tags: " + strings.Join(e, ", ")
 }
 
+// without returns those of the tags which are not in the removed list.
+func without(tags, removed []string) []string {
+	var result []string
+	for _, tag := range tags {
+		found := false
+		for _, r := range removed {
+			if tag == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
+// checkQuota returns ErrNoteTooLong or ErrTooManyNotes if adding a
+// note with given text would exceed the limits of the database.
+func (db *DB) checkQuota(tx *sql.Tx, text string) error {
+	if db.maxNoteSize > 0 && len(text) > db.maxNoteSize {
+		return ErrNoteTooLong
+	}
+	if db.maxNotes > 0 {
+		var count int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM notes").Scan(&count); err != nil {
+			return err
+		}
+		if count >= db.maxNotes {
+			return ErrTooManyNotes
+		}
+	}
+	return nil
+}
+
+// NoteEditCounts returns how many times each of the notes was edited
+// (based on the git history) or nil if git is not used.
+func (db *DB) NoteEditCounts(ids []int64) (map[int64]int, error) {
+	if db.git == nil {
+		return nil, nil
+	}
+	names := make([]string, len(ids))
+	for i, id := range ids {
+		names[i] = idToGitName(id)
+	}
+	counts, err := db.git.CommitCounts(names)
+	if err != nil {
+		return nil, err
+	}
+	edits := make(map[int64]int, len(ids))
+	for i, id := range ids {
+		if n := counts[names[i]]; n > 0 {
+			edits[id] = n - 1 // the commit adding the note
+		}
+	}
+	return edits, nil
+}
+
 type EditConflictError struct {
 	SHA1Sum string // sha1sum of note in the DB
 }
@@ -835,11 +2428,17 @@ func (e *EditConflictError) Error() string {
 
 // questionMarks returns cnt comma separated question marks to be used
 // in a query string with varying number of arguments.
+// It returns an empty string if cnt is not positive.
 func questionMarks(cnt int) string {
-	return strings.Repeat("?,", cnt)[:2*cnt-1]
+	return repeatNoLastChar("?,", cnt)
 }
 
+// repeatNoLastChar returns s repeated cnt times without the last
+// character (or an empty string if cnt is not positive).
 func repeatNoLastChar(s string, cnt int) string {
+	if cnt <= 0 || s == "" {
+		return ""
+	}
 	t := strings.Repeat(s, cnt)
 	return t[:len(t)-1]
 }
@@ -9,6 +9,8 @@ import (
 	"fmt"
 	"html/template"
 	"io"
+	"regexp"
+	"strings"
 	"unicode"
 	"unicode/utf8"
 
@@ -20,8 +22,14 @@ var NoDifference = errors.New("no difference")
 // htmlDiff writes diff of two given texts as HTML into the given
 // io.Writer. htmlDiff returns error only if there are no differences
 // between the texts (pseudo error NoDifference) or if there are
-// errors while writing to the given io.Writer.
-func htmlDiff(w io.Writer, oldText, newText string) (err error) {
+// errors while writing to the given io.Writer. If ignoreWhitespace is
+// true whitespace-only changes (such as rewrapped paragraphs) are not
+// reported.
+func htmlDiff(w io.Writer, oldText, newText string, ignoreWhitespace bool) (err error) {
+	if ignoreWhitespace {
+		oldText = normalizeWhitespace(oldText)
+		newText = normalizeWhitespace(newText)
+	}
 	dmp := diffmatchpatch.New()
 	a, b, lines := dmp.DiffLinesToRunes(oldText, newText)
 	diff := dmp.DiffCharsToLines(dmp.DiffMainRunes(a, b, false), lines)
@@ -53,6 +61,19 @@ func htmlDiff(w io.Writer, oldText, newText string) (err error) {
 	return nil
 }
 
+var paragraphBreak = regexp.MustCompile(`\n[ \t]*\n\s*`)
+
+// normalizeWhitespace replaces each run of whitespace with a single
+// space but keeps paragraphs (separated with blank lines) on separate
+// lines.
+func normalizeWhitespace(text string) string {
+	paragraphs := paragraphBreak.Split(strings.TrimSpace(text), -1)
+	for i, p := range paragraphs {
+		paragraphs[i] = strings.Join(strings.Fields(p), " ")
+	}
+	return strings.Join(paragraphs, "\n\n") + "\n"
+}
+
 func htmlTokenDiff(w io.Writer, dmp *diffmatchpatch.DiffMatchPatch, oldText, newText string) error {
 	a, b, tokens := tokensToRunes(oldText, newText)
 	diff := dmp.DiffCharsToLines(dmp.DiffMainRunes(a, b, false), tokens)
@@ -0,0 +1,151 @@
+// Copyright 2016 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// NoteEvent describes a change of a note.
+type NoteEvent struct {
+	ID   int64  `json:"id"`
+	Type string `json:"type"` // add, update, delete or restore
+	seq  int64  // event ID of the stream (see eventHub)
+}
+
+// eventsKeepAlive is the interval of comments sent to the event
+// stream clients so that idle connections are not closed by proxies.
+const eventsKeepAlive = 30 * time.Second
+
+// eventsKept is the number of the most recent events kept so that
+// they may be sent to clients reconnecting with Last-Event-ID.
+const eventsKept = 256
+
+// eventHub passes note events to the subscribers. Events are numbered
+// starting from the time the hub was created (so that the numbers grow
+// also across restarts). A subscriber which is too slow misses them.
+type eventHub struct {
+	mu     sync.Mutex
+	subs   map[chan NoteEvent]struct{}
+	seq    int64
+	recent []NoteEvent // at most eventsKept most recent events
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan NoteEvent]struct{}), seq: time.Now().UnixNano()}
+}
+
+// Subscribe returns a channel on which published events are received
+// until Unsubscribe is called. It also returns the kept events
+// published after the event with the given ID (if lastID is not zero)
+// and reports whether some of them are no longer kept (or lastID is
+// unknown).
+func (h *eventHub) Subscribe(lastID int64) (c chan NoteEvent, missed []NoteEvent, gap bool) {
+	c = make(chan NoteEvent, 16)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subs[c] = struct{}{}
+	if lastID == 0 || lastID == h.seq {
+		return c, nil, false
+	}
+	if lastID > h.seq || len(h.recent) == 0 || lastID < h.recent[0].seq-1 {
+		return c, nil, true
+	}
+	for _, e := range h.recent {
+		if e.seq > lastID {
+			missed = append(missed, e)
+		}
+	}
+	return c, missed, false
+}
+
+func (h *eventHub) Unsubscribe(c chan NoteEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, c)
+}
+
+// Publish numbers the event and sends it to all the subscribers
+// without blocking.
+func (h *eventHub) Publish(e NoteEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	e.seq = h.seq
+	if len(h.recent) == eventsKept {
+		h.recent = append(h.recent[:0], h.recent[1:]...)
+	}
+	h.recent = append(h.recent, e)
+	for c := range h.subs {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
+
+// serveEvents streams note events to the client as server-sent events
+// until the client disconnects. A client reconnecting with the
+// Last-Event-ID header first gets the events it missed, or a reset
+// event if they are no longer kept (then it should reload the notes).
+func (s *server) serveEvents(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	// the stream is not limited by -write_timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	lastID, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+	c, missed, gap := s.db.events.Subscribe(lastID)
+	defer s.db.events.Unsubscribe(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	var err error
+	if gap {
+		_, err = fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, e := range missed {
+		if err == nil {
+			err = writeEvent(w, e)
+		}
+	}
+	if err != nil {
+		return
+	}
+	f.Flush()
+	t := time.NewTicker(eventsKeepAlive)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-t.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case e := <-c:
+			err = writeEvent(w, e)
+		}
+		if err != nil {
+			return
+		}
+		f.Flush()
+	}
+}
+
+// writeEvent writes the note event in the server-sent events format.
+func writeEvent(w http.ResponseWriter, e NoteEvent) error {
+	b, err := json.Marshal(&e)
+	if err == nil {
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.seq, e.Type, b)
+	}
+	return err
+}
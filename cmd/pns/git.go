@@ -13,6 +13,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sync"
 	"time"
 )
 
@@ -33,6 +34,11 @@ type GitRepo struct {
 	author    string
 
 	indexBuf bytes.Buffer
+
+	// cached commit counts of files (updated on commit)
+	countsMu sync.Mutex
+	counts   map[string]int
+	staged   []string // files added or removed since the last commit
 }
 
 func NewGitRepo(dir string) *GitRepo {
@@ -77,14 +83,50 @@ func (g *GitRepo) Add(fileName string, data []byte) error {
 		return fmt.Errorf("git: failed to run hash-object: %v: %s", err, g.buf.Bytes())
 	}
 
-	cmd = g.command("git", "update-index", "--add", "--cacheinfo", fmt.Sprintf("100644,%s,%s", bytes.TrimSpace(blobHash), fileName))
+	blobHash = bytes.TrimSpace(blobHash)
+
+	// unchanged file is not counted as changed by the next commit
+	cmd = g.command("git", "ls-files", "--stage", "--", fileName)
+	entry, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("git: failed to run ls-files: %v: %s", err, g.buf.Bytes())
+	}
+	fields := bytes.Fields(entry)
+	changed := len(fields) < 2 || !bytes.Equal(fields[1], blobHash)
+
+	cmd = g.command("git", "update-index", "--add", "--cacheinfo", fmt.Sprintf("100644,%s,%s", blobHash, fileName))
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("git: failed to run update-index: %v: %s", err, g.buf.Bytes())
 	}
 
+	if changed {
+		g.stage(fileName)
+	}
 	return nil
 }
 
+func (g *GitRepo) Remove(fileName string) error {
+	_, _, err := g.getHEAD()
+	if err != nil {
+		return err
+	}
+
+	cmd := g.command("git", "update-index", "--force-remove", fileName)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git: failed to run update-index: %v: %s", err, g.buf.Bytes())
+	}
+
+	g.stage(fileName)
+	return nil
+}
+
+// stage records that the file is changed by the next commit.
+func (g *GitRepo) stage(fileName string) {
+	g.countsMu.Lock()
+	g.staged = append(g.staged, fileName)
+	g.countsMu.Unlock()
+}
+
 const RFC2822 = "Mon, 02 Jan 2006 15:04:05 -0700"
 
 func (g *GitRepo) Commit(msg string, authorDate time.Time) error {
@@ -106,14 +148,73 @@ func (g *GitRepo) Commit(msg string, authorDate time.Time) error {
 	args = append(args, "-m", msg, string(bytes.TrimSpace(treeHash)))
 	cmd = g.command("git", args...)
 	if !authorDate.IsZero() {
-		cmd.Env = append(cmd.Env, "GIT_AUTHOR_DATE="+authorDate.Format(RFC2822))
+		cmd.Env = append(cmd.Env, "GIT_AUTHOR_DATE="+authorDate.In(location).Format(RFC2822))
 	}
 	commitHash, err := cmd.Output()
 	if err != nil {
 		return fmt.Errorf("git: failed to run commit-tree: %v: %s", err, g.buf.Bytes())
 	}
 
-	return g.updateRef(refName, string(bytes.TrimSpace(commitHash)))
+	if err := g.updateRef(refName, string(bytes.TrimSpace(commitHash))); err != nil {
+		return err
+	}
+	g.countsMu.Lock()
+	for _, fileName := range g.staged {
+		if n, ok := g.counts[fileName]; ok {
+			g.counts[fileName] = n + 1
+		}
+	}
+	g.staged = nil
+	g.countsMu.Unlock()
+	return nil
+}
+
+// CommitCounts returns the numbers of commits changing given files.
+// Counts are cached (and updated by Commit) and the counts of all the
+// files missing in the cache are read with a single git log.
+func (g *GitRepo) CommitCounts(fileNames []string) (map[string]int, error) {
+	counts := make(map[string]int, len(fileNames))
+	var missing []string
+	g.countsMu.Lock()
+	for _, fileName := range fileNames {
+		if n, ok := g.counts[fileName]; ok {
+			counts[fileName] = n
+		} else {
+			missing = append(missing, fileName)
+		}
+	}
+	g.countsMu.Unlock()
+	if len(missing) == 0 {
+		return counts, nil
+	}
+
+	// not using g.command as it is not safe for concurrent use
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", append([]string{"log", "--format=", "--name-only", "HEAD", "--"}, missing...)...)
+	cmd.Env = g.env
+	cmd.Stderr = &stderr
+	b, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git: failed to run log: %v: %s", err, stderr.Bytes())
+	}
+	for _, fileName := range missing {
+		counts[fileName] = 0
+	}
+	for _, line := range bytes.Split(b, []byte{'\n'}) {
+		if n, ok := counts[string(line)]; ok {
+			counts[string(line)] = n + 1
+		}
+	}
+
+	g.countsMu.Lock()
+	if g.counts == nil {
+		g.counts = make(map[string]int)
+	}
+	for _, fileName := range missing {
+		g.counts[fileName] = counts[fileName]
+	}
+	g.countsMu.Unlock()
+	return counts, nil
 }
 
 func (g *GitRepo) updateRef(refName, hash string) error {
@@ -323,8 +424,8 @@ func (g *GitRepo) writeCommit(id int, tree, parent SHA1, authorDate time.Time) (
 	if parent != g.emptySHA1 {
 		fmt.Fprintf(&g.buf, "parent %x\n", parent)
 	}
-	t := time.Now()
-	fmt.Fprintf(&g.buf, "author %s %d %s\n", g.author, authorDate.Unix(), authorDate.Format("-0700"))
+	t := time.Now().In(location)
+	fmt.Fprintf(&g.buf, "author %s %d %s\n", g.author, authorDate.Unix(), authorDate.In(location).Format("-0700"))
 	fmt.Fprintf(&g.buf, "committer %s %d %s\n\n%d\n", g.author, t.Unix(), t.Format("-0700"), id)
 	return g.hashObject(objectCommit, g.buf.Bytes())
 }
@@ -5,14 +5,31 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
+// logger logs requests. If bodies is set the form fields of POST
+// requests to the API (under base) are logged as well (see
+// loggedForm).
 type logger struct {
 	handler http.Handler
+	bodies  bool
+	base    string
 }
 
 func (l *logger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -21,13 +38,123 @@ func (l *logger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.URL.RawQuery != "" {
 		path += "?" + r.URL.RawQuery
 	}
+	id := requestID(r)
+	w.Header().Set("X-Request-ID", id)
 	rw := &responseWriter{w, 0, false}
+	if l.bodies && r.Method == "POST" && strings.HasPrefix(r.URL.Path, l.base+"/_/api/") {
+		if form := readForm(r); form != "" {
+			log.Println("id="+id, "form:", form)
+		}
+	}
 	defer func() {
-		log.Println(remoteAddr(r), r.Host, r.Method, path, "-", rw.status, http.StatusText(rw.status), time.Since(t))
+		log.Println(remoteAddr(r), r.Host, r.Method, path, "-", rw.status, http.StatusText(rw.status), time.Since(t), "id="+id)
 	}()
 	l.handler.ServeHTTP(rw, r)
 }
 
+// maxLoggedBody is the maximum number of bytes of a request body read
+// for logging (fields beyond it are not logged) and maxLoggedValue the
+// maximum length of a logged field value.
+const (
+	maxLoggedBody  = 64 << 10
+	maxLoggedValue = 64
+)
+
+// readForm returns the form fields of the request body as logged (see
+// loggedForm). The body is restored so that the handler may read it.
+func readForm(r *http.Request) string {
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxLoggedBody))
+	r.Body = &replayBody{io.MultiReader(bytes.NewReader(b), r.Body), r.Body}
+	if err != nil {
+		return ""
+	}
+	return loggedForm(r.Header.Get("Content-Type"), b)
+}
+
+type replayBody struct {
+	io.Reader
+	io.Closer
+}
+
+// loggedForm returns the fields of the URL encoded or multipart form
+// body b (possibly truncated) sorted by name with values quoted and
+// truncated to maxLoggedValue bytes. Values of sensitive fields (such
+// as passwords) are never logged (see redactedField).
+func loggedForm(contentType string, b []byte) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	form := make(url.Values)
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		// errors are ignored as the body may be truncated
+		form, _ = url.ParseQuery(string(b))
+	case "multipart/form-data":
+		mr := multipart.NewReader(bytes.NewReader(b), params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			if p.FileName() != "" {
+				form.Add(p.FormName(), "file "+p.FileName())
+				continue
+			}
+			v, err := ioutil.ReadAll(p)
+			if err != nil {
+				break
+			}
+			form.Add(p.FormName(), string(v))
+		}
+	default:
+		return ""
+	}
+	names := make([]string, 0, len(form))
+	for name := range form {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var fields []string
+	for _, name := range names {
+		for _, v := range form[name] {
+			if redactedField(name) {
+				v = "[redacted]"
+			} else {
+				v = truncateValue(v)
+			}
+			n := name
+			if !validRequestID(n) { // same rules as for safely logged request IDs
+				n = strconv.Quote(n)
+			}
+			fields = append(fields, fmt.Sprintf("%s=%q", n, v))
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// redactedField reports whether the value of the form field must not
+// be logged (passwords, two-factor authentication codes, session
+// handles and tokens).
+func redactedField(name string) bool {
+	name = strings.ToLower(name)
+	return name == "code" || name == "handle" ||
+		strings.Contains(name, "password") || strings.Contains(name, "token") || strings.Contains(name, "secret")
+}
+
+// truncateValue truncates v to at most maxLoggedValue bytes (at a rune
+// boundary) marking truncated values with an ellipsis.
+func truncateValue(v string) string {
+	if len(v) <= maxLoggedValue {
+		return v
+	}
+	i := maxLoggedValue
+	for i > 0 && !utf8.RuneStart(v[i]) {
+		i--
+	}
+	return v[:i] + "…"
+}
+
 func remoteAddr(r *http.Request) string {
 	forward := r.Header.Get("X-Forwarded-For")
 	if forward != "" {
@@ -36,6 +163,38 @@ func remoteAddr(r *http.Request) string {
 	return r.RemoteAddr
 }
 
+// maxRequestIDLen is the maximum length of X-Request-ID accepted from
+// the client (longer IDs are replaced with generated ones).
+const maxRequestIDLen = 128
+
+// requestID returns request ID given in X-Request-ID header (e.g., by
+// a reverse proxy) or a new random one if absent or invalid.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); validRequestID(id) {
+		return id
+	}
+	var a [8]byte
+	if _, err := rand.Read(a[:]); err != nil {
+		return "-"
+	}
+	return hex.EncodeToString(a[:])
+}
+
+// validRequestID reports whether id is non-empty, not too long and
+// consists of printable ASCII characters other than space (so that it
+// may be safely written to the log).
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
 type responseWriter struct {
 	http.ResponseWriter
 	status      int
@@ -54,3 +213,16 @@ func (w *responseWriter) Write(b []byte) (int, error) {
 	}
 	return w.ResponseWriter.Write(b)
 }
+
+// Unwrap returns the underlying http.ResponseWriter (used by
+// http.ResponseController).
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush implements http.Flusher (used by streaming handlers).
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
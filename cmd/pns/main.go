@@ -6,19 +6,32 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha1"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"flag"
 	"fmt"
 	"html/template"
 	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/bgentry/speakeasy"
@@ -28,28 +41,143 @@ import (
 const (
 	sessionDuration   = 3600 // session duration in seconds
 	sessionCookieName = "pns_sid"
+	relatedTagsLimit  = 10
 )
 
 var (
 	dbFileName = flag.String("f", "", "sqlite3 database `file` name")
 	dbInit     = flag.String("init", "", "initialize the database file (argument is `options` such as git,lang=en or nogit,lang=pl)")
 	dbAddUser  = flag.String("adduser", "", "add `user` with given login to the database file (asks for the password)")
+	minPassLen = flag.Int("min_password", 8, "minimum `length` of passwords of users added with -adduser")
+	listUsers  = flag.Bool("listusers", false, "print logins of all the users in the database file")
+	unlockUser = flag.String("unlock", "", "unlock account of `user` with given login (locked after failed login attempts or with -disable)")
+	disableUsr = flag.String("disable", "", "disable account of `user` with given login (until unlocked with -unlock)")
+	enableTOTP = flag.String("enable_totp", "", "enable two-factor authentication (TOTP) of `user` with given login (prints the secret to be entered in an authenticator application)")
+	noTOTP     = flag.String("disable_totp", "", "disable two-factor authentication of `user` with given login")
 	importFrom = flag.String("import", "", "import notes from given `file`")
+	keepIDs    = flag.Bool("keep_ids", false, "preserve IDs of notes imported with -import (unless already used in the database)")
+	mergeFrom  = flag.String("merge", "", "merge notes from another pns database `file` (keeping note IDs unless already used and reusing existing tag names)")
+	importDir  = flag.String("import_dir", "", "import markdown files (*.md) in given `directory` (recursively) as notes")
 	exportPath = flag.String("export", "", `export path, use "/" for all notes`)
-	outFile    = flag.String("o", "", "output `file`, use with -export")
-	httpAddr   = flag.String("http", "", "HTTP listen `address`")
+	exportExpr = flag.String("export_query", "", "export notes matching search `expression` (as entered in the search field)")
+	separator  = flag.String("separator", "", "notes separator `line` (starting with ***) used by -export and expected by -import, by default one not occurring in the notes is used")
+	outFile    = flag.String("o", "", "output `file`, use with -export or -export_query")
+	backupTo   = flag.String("backup", "", "write a consistent copy of the database to a new `file` (also while pns is running), the .git repository is not included")
+	noIDs      = flag.Bool("export_without_ids", false, "omit note IDs with -export and -export_query (for comparing exports of different databases)")
+	exportDir  = flag.String("export_dir", "", "export each note to a separate markdown file in given `directory` (all notes unless -export or -export_query is given)")
+	httpAddr   = flag.String("http", "", "HTTP listen `address` (or unix:path of a Unix domain socket)")
 	httpsAddr  = flag.String("https", "", "HTTPS listen `address`")
 	certFile   = flag.String("https_cert", "", "HTTPS server certificate `file`")
 	keyFile    = flag.String("https_key", "", "HTTPS server private key `file`")
-	hostname   = flag.String("host", "", "reject requests with `host` other than this")
+	hostname   = flag.String("host", "", "reject requests with host other than this (or comma separated `hosts`)")
 	version    = flag.Bool("v", false, "show program version")
 	update     = flag.String("update", "", "update database (argument is `options` such as git,lang=en or nogit,lang=pl)")
+	dryRun     = flag.Bool("dry_run", false, "only show what -init or -update would do")
+	migrate    = flag.Bool("migrate", false, "migrate database created by an older version of pns to the current version")
+	checkDB    = flag.Bool("check", false, "check the database schema and whether the full text search index matches the notes")
+	reindex    = flag.Bool("reindex", false, "rebuild the full text search index")
+	orphans    = flag.Bool("check_orphans", false, "report notes without any topics or tags (which cannot be found by browsing)")
+	tagOrphans = flag.String("tag_orphans", "", "add `topic` (such as /orphan) to notes without any topics or tags")
+	emptyTrash = flag.Int("empty_trash", -1, "remove notes moved to the trash more than given number of `days` ago")
+	homePage   = flag.String("home", "index", "home page shows either `index` of topics and tags or recent notes")
+	timeZone   = flag.String("tz", "", "time `zone` (such as Europe/Warsaw) used to present dates, the default is the local time zone")
+	dateLayout = flag.String("date_layout", "2006-01-02", "`layout` of note dates shown in listings (as in Go time package)")
+	secCookie  = flag.String("secure_cookie", "auto", "mark session cookie as secure: `auto` (only with -https), always (such as behind HTTPS reverse proxy) or never")
+	maxNotes   = flag.Int("max_notes", 0, "maximum `number` of notes (including those in the trash), 0 for no limit")
+	maxNoteLen = flag.Int("max_note_size", 0, "maximum size of a note in `bytes`, 0 for no limit")
+	keepFront  = flag.Bool("keep_front_matter", false, "keep front matter (declaring topics and tags) in the text of added and imported notes")
+	staticBase = flag.String("static_base_url", "", "base `URL` of the static assets (style sheets, scripts and icons) referenced by the pages, such as on a CDN, instead of /_/static of pns")
+	staticURL  = flag.String("static_url", "/_/static", "base `URL` substituted for {{static}} in the text of notes when rendered")
+	pubVersion = flag.Bool("public_version", false, "serve /_/version (build information) also to not logged in users")
+	events     = flag.Bool("events", false, "stream events of added, updated, deleted and restored notes at /_/events (server-sent events)")
+	sameSite   = flag.String("same_site", "lax", "SameSite attribute of the session cookie: `lax` or strict")
+	basePath   = flag.String("base_path", "", "serve pns under given `path` prefix (such as /notes) when hosted on a subpath behind a reverse proxy")
+	pageTitle  = flag.String("title", "pns", "instance `name` shown in the page title and header (to tell apart several pns instances)")
+	logBodies  = flag.Bool("debug_log_bodies", false, "log form fields of POST requests to /_/api/ (truncated, passwords and tokens redacted) for debugging")
 
 	Version = "pns-0.1-(REV?)"
 )
 
+var (
+	readTimeout  = flag.Duration("read_timeout", 30*time.Second, "maximum `duration` for reading the entire request")
+	writeTimeout = flag.Duration("write_timeout", 60*time.Second, "maximum `duration` of writing the response (except for the /_/events stream), 0 for no limit")
+	idleTimeout  = flag.Duration("idle_timeout", 120*time.Second, "maximum `duration` of waiting for the next request on a keep-alive connection")
+	maxStart     = flag.Int("max_start", 10000, "maximum `offset` of listed notes when paging (deeper paging makes the database skip that many notes), 0 for no limit")
+	queryTimeout = flag.Duration("query_timeout", 10*time.Second, "maximum `duration` of database queries of a listing of notes, 0 for no limit")
+	maxFailures  = flag.Int("max_login_failures", 10, "lock account after given `number` of consecutive failed login attempts, 0 for no limit")
+	slowQuery    = flag.Int("slow_query_ms", 0, "log queries of notes taking longer than given number of `milliseconds`, 0 to disable")
+	remember     = flag.Duration("remember", 30*24*time.Hour, "`duration` of sessions of users who checked \"remember me\" on login")
+	lockout      = flag.Duration("lockout", 15*time.Minute, "`duration` of the account lock after too many failed login attempts")
+)
+
+// envFlags maps names of flags configuring the server to environment
+// variables used when the flags are not given (e.g., in containers).
+var envFlags = map[string]string{
+	"f":                  "PNS_DB_FILE",
+	"http":               "PNS_HTTP",
+	"https":              "PNS_HTTPS",
+	"https_cert":         "PNS_HTTPS_CERT",
+	"https_key":          "PNS_HTTPS_KEY",
+	"host":               "PNS_HOST",
+	"home":               "PNS_HOME",
+	"tz":                 "PNS_TZ",
+	"date_layout":        "PNS_DATE_LAYOUT",
+	"secure_cookie":      "PNS_SECURE_COOKIE",
+	"same_site":          "PNS_SAME_SITE",
+	"max_notes":          "PNS_MAX_NOTES",
+	"max_note_size":      "PNS_MAX_NOTE_SIZE",
+	"keep_front_matter":  "PNS_KEEP_FRONT_MATTER",
+	"static_url":         "PNS_STATIC_URL",
+	"static_base_url":    "PNS_STATIC_BASE_URL",
+	"public_version":     "PNS_PUBLIC_VERSION",
+	"events":             "PNS_EVENTS",
+	"base_path":          "PNS_BASE_PATH",
+	"title":              "PNS_TITLE",
+	"read_timeout":       "PNS_READ_TIMEOUT",
+	"write_timeout":      "PNS_WRITE_TIMEOUT",
+	"idle_timeout":       "PNS_IDLE_TIMEOUT",
+	"query_timeout":      "PNS_QUERY_TIMEOUT",
+	"max_start":          "PNS_MAX_START",
+	"max_login_failures": "PNS_MAX_LOGIN_FAILURES",
+	"slow_query_ms":      "PNS_SLOW_QUERY_MS",
+	"remember":           "PNS_REMEMBER",
+	"lockout":            "PNS_LOCKOUT",
+	"debug_log_bodies":   "PNS_DEBUG_LOG_BODIES",
+}
+
+// addEnvUsage mentions the environment variables of envFlags in the
+// usage of the flags.
+func addEnvUsage(fs *flag.FlagSet) {
+	for name, env := range envFlags {
+		if f := fs.Lookup(name); f != nil {
+			f.Usage += " (or $" + env + ")"
+		}
+	}
+}
+
+// setFlagsFromEnv sets the flags of envFlags not given on the command
+// line from the (non-empty) environment variables.
+func setFlagsFromEnv(fs *flag.FlagSet, lookupEnv func(string) (string, bool)) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for name, env := range envFlags {
+		value, ok := lookupEnv(env)
+		if !ok || value == "" || given[name] || fs.Lookup(name) == nil {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value %q of %s: %v", value, env, err)
+		}
+	}
+	return nil
+}
+
 func main() {
+	addEnvUsage(flag.CommandLine)
 	flag.Parse()
+	if err := setFlagsFromEnv(flag.CommandLine, os.LookupEnv); err != nil {
+		log.Fatal(err)
+	}
 	if *version {
 		fmt.Println(Version)
 		return
@@ -57,83 +185,293 @@ func main() {
 	if *dbFileName == "" {
 		log.Fatal("option -f is requiered")
 	}
+	if *separator != "" {
+		if err := checkSeparator(*separator); err != nil {
+			log.Fatal("invalid -separator option: ", err)
+		}
+	}
+	if *timeZone != "" {
+		loc, err := time.LoadLocation(*timeZone)
+		if err != nil {
+			log.Fatal("invalid -tz option: ", err)
+		}
+		location = loc
+	}
+	if *dryRun && (*dbInit == "") == (*update == "") {
+		log.Fatal("option -dry_run requires either -init or -update")
+	}
 	db, err := OpenDB(*dbFileName)
 	if err != nil {
 		log.Fatal(err)
 	}
+	db.maxNotes = *maxNotes
+	db.maxNoteSize = *maxNoteLen
+	db.maxFailures = *maxFailures
+	db.lockout = *lockout
+	db.minPassword = *minPassLen
+	db.slowQuery = time.Duration(*slowQuery) * time.Millisecond
 	if *dbInit != "" {
 		git, lang, err := parseOptions(*dbInit)
 		if err != nil {
 			log.Fatal("failed to initialize database: ", err)
 		}
-		if err = db.Init(git, lang); err != nil {
+		if err = db.Init(git, lang, *dryRun); err != nil {
 			log.Fatal("failed to initialize database: ", err)
 		}
+		if *dryRun {
+			return
+		}
 	}
 	if *importFrom != "" {
-		notes, err := parseFile(*importFrom)
+		if err := db.CheckSchema(); err != nil {
+			log.Fatal("failed to import: ", err)
+		}
+		notes, err := parseFile(*importFrom, *separator)
 		if err != nil {
 			log.Fatal("failed to parse imported file: ", err)
 		}
-		if err := db.Import(notes); err != nil {
+		for _, n := range notes {
+			n.Text, n.Topics, n.Tags = mergeFrontMatter(n.Text, n.Topics, n.Tags, *keepFront)
+		}
+		if err := db.Import(notes, *keepIDs); err != nil {
 			log.Fatal("failed to import into database: ", err)
 		}
 	}
-	if *dbAddUser != "" {
-		pass, err := speakeasy.Ask("Password: ")
+	if *mergeFrom != "" {
+		if err := db.CheckSchema(); err != nil {
+			log.Fatal("failed to merge: ", err)
+		}
+		other, err := OpenDB(*mergeFrom)
 		if err != nil {
-			log.Fatal("failed to add user: ", err)
+			log.Fatal("failed to merge: ", err)
+		}
+		if err := other.CheckSchema(); err != nil {
+			log.Fatal("failed to merge: ", err)
+		}
+		notes, err := other.AllNotes()
+		if err != nil {
+			log.Fatal("failed to merge: ", err)
 		}
-		repeat, err := speakeasy.Ask("Retype password: ")
+		addedNotes, addedTags, err := db.Merge(notes)
 		if err != nil {
+			log.Fatal("failed to merge: ", err)
+		}
+		log.Printf("merged %d notes (added %d new topics and tags)", addedNotes, addedTags)
+	}
+	if *importDir != "" {
+		if err := db.CheckSchema(); err != nil {
+			log.Fatal("failed to import: ", err)
+		}
+		notes, err := parseDir(*importDir, *keepFront)
+		if errs, ok := err.(MultiError); ok {
+			for _, err := range errs {
+				log.Print("skipped: ", err)
+			}
+		} else if err != nil {
+			log.Fatal("failed to import directory: ", err)
+		}
+		if err := db.Import(notes, false); err != nil {
+			log.Fatal("failed to import into database: ", err)
+		}
+		log.Printf("imported %d notes", len(notes))
+	}
+	if *dbAddUser != "" {
+		if err := db.CheckSchema(); err != nil {
 			log.Fatal("failed to add user: ", err)
 		}
-		if repeat != pass {
-			log.Fatal("failed to add user: passwords do not match")
+		pass, err := askPassword(*dbAddUser, db.minPassword)
+		if err != nil {
+			log.Fatal("failed to add user: ", err)
 		}
 		if err = db.AddUser(*dbAddUser, []byte(pass)); err != nil {
 			log.Fatal("failed to add user: ", err)
 		}
 	}
-	if *exportPath != "" {
-		var w io.Writer
-		if *outFile != "" {
-			f, err := os.Create(*outFile)
-			if err != nil {
-				log.Fatal("failed to export: ", err)
-			}
-			defer f.Close()
-			w = f
-		} else {
-			w = os.Stdout
+	if *listUsers {
+		if err := db.CheckSchema(); err != nil {
+			log.Fatal("failed to list users: ", err)
+		}
+		logins, err := db.Users()
+		if err != nil {
+			log.Fatal("failed to list users: ", err)
+		}
+		for _, login := range logins {
+			fmt.Println(login)
+		}
+	}
+	if *unlockUser != "" {
+		if err := db.CheckSchema(); err != nil {
+			log.Fatal("failed to unlock user: ", err)
+		}
+		if err := db.UnlockUser(*unlockUser); err != nil {
+			log.Fatal("failed to unlock user: ", err)
+		}
+	}
+	if *enableTOTP != "" {
+		if err := db.CheckSchema(); err != nil {
+			log.Fatal("failed to enable two-factor authentication: ", err)
+		}
+		secret, err := db.EnableTOTP(*enableTOTP)
+		if err != nil {
+			log.Fatal("failed to enable two-factor authentication: ", err)
+		}
+		fmt.Println("secret:", secret)
+		fmt.Println("URI (for a QR code):", totpURI("PNS", *enableTOTP, secret))
+	}
+	if *noTOTP != "" {
+		if err := db.CheckSchema(); err != nil {
+			log.Fatal("failed to disable two-factor authentication: ", err)
+		}
+		if err := db.DisableTOTP(*noTOTP); err != nil {
+			log.Fatal("failed to disable two-factor authentication: ", err)
+		}
+	}
+	if *disableUsr != "" {
+		if err := db.CheckSchema(); err != nil {
+			log.Fatal("failed to disable user: ", err)
+		}
+		if err := db.DisableUser(*disableUsr); err != nil {
+			log.Fatal("failed to disable user: ", err)
+		}
+	}
+	if *exportPath != "" && *exportExpr != "" {
+		log.Fatal("please specify either -export or -export_query but not both")
+	}
+	if *exportDir != "" && *outFile != "" {
+		log.Fatal("please specify either -o or -export_dir but not both")
+	}
+	if *exportPath != "" || *exportExpr != "" || *exportDir != "" {
+		if err := db.CheckSchema(); err != nil {
+			log.Fatal("failed to export: ", err)
 		}
 		var notes []*Note
-		if (*exportPath)[0] != '/' {
-			log.Fatal("failed to export: export path must start with '/'")
-		} else if *exportPath == "/" {
+		if *exportExpr != "" {
+			notes, err = searchAllNotes(db, *exportExpr)
+		} else if *exportPath == "" || *exportPath == "/" {
 			notes, err = db.AllNotes()
 		} else {
-			tags := strings.Split(*exportPath, "/")
-			notes, err = db.Notes("/"+tags[1], tags[2:], "", 0, false)
+			var topic string
+			var tags []string
+			if topic, tags, err = exportPathTags(*exportPath); err == nil {
+				notes, err = db.Notes(topic, tags, "", 0, orderByID, false, nil)
+			}
 		}
-		if err == nil {
-			err = export(w, notes)
+		if err == nil && len(notes) == 0 {
+			// do not leave an empty file (or directory)
+			err = ErrNoNotes
+		} else if err == nil && *exportDir != "" {
+			err = exportToDir(*exportDir, notes)
+		} else if err == nil {
+			var w io.Writer
+			if *outFile != "" {
+				f, err := os.Create(*outFile)
+				if err != nil {
+					log.Fatal("failed to export: ", err)
+				}
+				defer f.Close()
+				w = f
+			} else {
+				w = os.Stdout
+			}
+			err = export(w, notes, *separator, !*noIDs)
 		}
 		if err != nil {
 			log.Fatal("failed to export: ", err)
 		}
 	}
+	if *reindex {
+		if err := db.CheckSchema(); err != nil {
+			log.Fatal("failed to reindex: ", err)
+		}
+		n, err := db.Reindex()
+		if err != nil {
+			log.Fatal("failed to reindex: ", err)
+		}
+		log.Printf("indexed %d notes", n)
+	}
+	if *checkDB {
+		if err := db.CheckSchema(); err != nil {
+			log.Fatal("check failed: ", err)
+		}
+		if err := db.CheckFTSConsistency(); err != nil {
+			log.Fatal("check failed: ", err)
+		}
+		log.Print("database OK")
+	}
+	if *orphans {
+		if err := db.CheckSchema(); err != nil {
+			log.Fatal("failed to check orphan notes: ", err)
+		}
+		ids, err := db.OrphanNotes()
+		if err != nil {
+			log.Fatal("failed to check orphan notes: ", err)
+		}
+		for _, id := range ids {
+			fmt.Println(id)
+		}
+		log.Printf("found %d notes without topics or tags", len(ids))
+	}
+	if *tagOrphans != "" {
+		if err := db.CheckSchema(); err != nil {
+			log.Fatal("failed to tag orphan notes: ", err)
+		}
+		useGit, _, err := db.getPNSOptions()
+		if err != nil {
+			log.Fatal("failed to tag orphan notes: ", err)
+		}
+		if !useGit {
+			db.git = nil
+		}
+		ids, err := db.TagOrphanNotes(*tagOrphans)
+		if err != nil {
+			log.Fatal("failed to tag orphan notes: ", err)
+		}
+		log.Printf("added %s to %d notes", *tagOrphans, len(ids))
+	}
+	if *backupTo != "" {
+		if err := db.CheckSchema(); err != nil {
+			log.Fatal("failed to back up: ", err)
+		}
+		if err := db.Backup(*backupTo); err != nil {
+			log.Fatal("failed to back up: ", err)
+		}
+	}
+	if *emptyTrash >= 0 {
+		if err := db.CheckSchema(); err != nil {
+			log.Fatal("failed to empty trash: ", err)
+		}
+		useGit, _, err := db.getPNSOptions()
+		if err != nil {
+			log.Fatal("failed to empty trash: ", err)
+		}
+		if !useGit {
+			db.git = nil
+		}
+		n, err := db.EmptyTrash(time.Now().AddDate(0, 0, -*emptyTrash))
+		if err != nil {
+			log.Fatal("failed to empty trash: ", err)
+		}
+		log.Printf("removed %d notes from the trash", n)
+	}
+	if *migrate {
+		if err := db.Migrate(); err != nil {
+			log.Fatal("failed to migrate: ", err)
+		}
+		return
+	}
 	if *update != "" {
 		git, lang, err := parseOptions(*update)
 		if err != nil {
 			log.Fatal("failed to update: ", err)
 		}
-		if err := updateDB(db, *dbFileName, git, lang); err != nil {
+		if err := updateDB(db, *dbFileName, git, lang, *dryRun); err != nil {
 			log.Fatal("failed to update: ", err)
 		}
 		return
 	}
-	if *dbInit != "" || *importFrom != "" || *dbAddUser != "" || *exportPath != "" {
+	if *dbInit != "" || *importFrom != "" || *importDir != "" || *dbAddUser != "" || *exportPath != "" || *exportExpr != "" || *exportDir != "" || *emptyTrash >= 0 ||
+		*mergeFrom != "" || *unlockUser != "" || *disableUsr != "" || *enableTOTP != "" || *noTOTP != "" || *backupTo != "" || *reindex || *checkDB || *listUsers ||
+		*orphans || *tagOrphans != "" {
 		return
 	}
 	if *httpAddr == "" && *httpsAddr == "" {
@@ -145,7 +483,45 @@ func main() {
 	if *httpsAddr != "" && (*certFile == "" || *keyFile == "") {
 		log.Fatal("-https option requires -https_cert and -https_key options")
 	}
+	if *homePage != "index" && *homePage != "recent" {
+		log.Fatal("-home option must be either index or recent")
+	}
+	secure := *httpsAddr != ""
+	switch *secCookie {
+	case "auto":
+	case "always":
+		secure = true
+	case "never":
+		secure = false
+	default:
+		log.Fatal("-secure_cookie option must be auto, always or never")
+	}
+	sameSiteMode := http.SameSiteLaxMode
+	switch *sameSite {
+	case "lax":
+	case "strict":
+		sameSiteMode = http.SameSiteStrictMode
+	default:
+		log.Fatal("-same_site option must be either lax or strict")
+	}
+	base, err := cleanBasePath(*basePath)
+	if err != nil {
+		log.Fatal("invalid -base_path option: ", err)
+	}
+	if base != "" && *staticURL == "/_/static" {
+		*staticURL = base + *staticURL
+	}
+	assets := base + "/_/static"
+	if *staticBase != "" {
+		assets = strings.TrimSuffix(*staticBase, "/")
+	}
 
+	if err := db.CheckSchema(); err != nil {
+		log.Fatal(err)
+	}
+	if err := db.CheckFTSConsistency(); err != nil {
+		log.Print("warning: ", err)
+	}
 	useGit, lang, err := db.getPNSOptions()
 	if err != nil {
 		log.Fatal("db options error: ", err)
@@ -158,7 +534,11 @@ func main() {
 		log.Printf("unsupported translation language %s, using en (i.e., English) instead", lang)
 		tr = translations["en"]
 	}
-	m := template.FuncMap{"tr": tr.translate, "htmlTr": tr.htmlTranslate}
+	m := template.FuncMap{"tr": tr.translate, "htmlTr": tr.htmlTranslate, "base": func() string { return base },
+		"static":          func() string { return assets },
+		"relative":        func(t time.Time) string { return relativeTime(time.Since(t), tr) },
+		"relativeFormats": func() *relativeFormats { return newRelativeFormats(tr) },
+		"shortLink":       shortLink}
 	t, err := newTemplate(m,
 		"templates/diff.html",
 		"templates/edit.html",
@@ -170,27 +550,227 @@ func main() {
 		log.Fatal(err)
 	}
 	dir := newDir("static/")
-	s := &server{db, t, markdown.New(), NewSessions(), *httpsAddr != "", tr.translate, dir}
+	s := &server{db, t, markdown.New(), NewSessions(), secure, sameSiteMode, tr.translate, dir, *homePage == "recent", newSubmitTokens(), &maintenance{}, *pageTitle, base, assets}
+	toggleMaintenanceOnSignal(s.maint)
 	http.Handle("/", s.authenticate(s.ServeHTTP))
 	http.HandleFunc("/_/edit/", s.authenticate(s.serveEdit))
 	http.HandleFunc("/_/api/edit/submit/", s.authenticate(s.serveAPIEditSubmit))
 	http.HandleFunc("/_/add", s.authenticate(s.serveAdd))
 	http.HandleFunc("/_/api/add/submit", s.authenticate(s.serveAPIAddSubmit))
+	http.HandleFunc("/_/api/quickadd", s.authenticate(s.serveAPIQuickAdd))
+	http.HandleFunc("/_/api/notes", s.authenticate(s.serveAPINotes))
+	http.HandleFunc("/_/api/activity", s.authenticate(s.serveAPIActivity))
+	http.HandleFunc("/_/api/sync", s.authenticate(s.serveAPISync))
+	http.HandleFunc("/_/api/vocabulary", s.authenticate(s.serveAPIVocabulary))
+	http.HandleFunc("/_/api/render", s.authenticate(s.serveAPIRender))
+	http.HandleFunc("/_/api/sessions/clear", s.authenticate(s.serveAPIClearSessions))
+	http.HandleFunc("/_/api/maintenance", s.authenticate(s.serveAPIMaintenance))
+	http.HandleFunc("/_/api/backup", s.authenticate(s.serveAPIBackup))
+	http.HandleFunc("/_/sessions", s.authenticate(s.serveSessions))
+	http.HandleFunc("/_/sessions/revoke", s.authenticate(s.serveRevokeSession))
 	http.HandleFunc("/_/copy/", s.authenticate(s.serveCopy))
+	http.HandleFunc("/_/delete/", s.authenticate(s.serveDelete))
+	http.HandleFunc("/_/restore/", s.authenticate(s.serveRestore))
+	http.HandleFunc("/_/trash", s.authenticate(s.serveTrash))
+	if *events {
+		db.events = newEventHub()
+		http.HandleFunc("/_/events", s.authenticate(s.serveEvents))
+	}
+	http.HandleFunc("/_/note/", s.authenticate(s.serveNote))
+	http.HandleFunc("/_/n/", s.authenticate(s.serveShortLink))
 	http.Handle("/_/static/", http.StripPrefix("/_/static/", http.FileServer(dir)))
+	http.HandleFunc("/_/opensearch.xml", s.serveOpenSearch)
+	http.HandleFunc("/favicon.ico", s.serveFavicon)
+	http.HandleFunc("/_/manifest.webmanifest", s.serveManifest)
+	http.HandleFunc("/_/sw.js", s.serveServiceWorker)
+	if *pubVersion {
+		http.HandleFunc("/_/version", s.serveVersion)
+	} else {
+		http.HandleFunc("/_/version", s.authenticate(s.serveVersion))
+	}
 	http.HandleFunc("/_/login", s.serveLogin)
 	http.HandleFunc("/_/api/login", s.serveAPILogin)
 	http.HandleFunc("/_/logout/", s.serveLogout)
 	http.HandleFunc("/_/", s.authenticate(s.notFound))
 	var h http.Handler = http.DefaultServeMux
+	if base != "" {
+		h = &basePathHandler{base, h}
+	}
 	if *hostname != "" {
-		h = newHostChecker(*hostname, h)
+		hc, err := newHostChecker(*hostname, h)
+		if err != nil {
+			log.Fatal("invalid -host option: ", err)
+		}
+		h = hc
+	}
+	h = &logger{h, *logBodies, base}
+	srv := &http.Server{
+		Addr:         *httpAddr,
+		Handler:      h,
+		ReadTimeout:  *readTimeout,
+		WriteTimeout: *writeTimeout,
+		IdleTimeout:  *idleTimeout,
 	}
-	h = &logger{h}
 	if *httpsAddr != "" {
-		log.Fatal(http.ListenAndServeTLS(*httpsAddr, *certFile, *keyFile, h))
+		srv.Addr = *httpsAddr
+		log.Fatal(srv.ListenAndServeTLS(*certFile, *keyFile))
+	} else if strings.HasPrefix(*httpAddr, "unix:") {
+		if err := serveUnix(srv, strings.TrimPrefix(*httpAddr, "unix:")); err != nil {
+			log.Fatal(err)
+		}
 	} else {
-		log.Fatal(http.ListenAndServe(*httpAddr, h))
+		log.Fatal(srv.ListenAndServe())
+	}
+}
+
+// serveUnix serves HTTP on a Unix domain socket (e.g., behind a reverse
+// proxy on the same host). A stale socket file is removed first and
+// the socket file is removed on SIGINT or SIGTERM.
+func serveUnix(srv *http.Server, path string) error {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+	// closing the listener (on Shutdown) removes the socket file
+	err = srv.Serve(l)
+	if err == http.ErrServerClosed {
+		err = nil
+	}
+	return err
+}
+
+// startTime is the time pns was started, pages rendered by an earlier
+// instance (possibly with other templates) are not considered fresh.
+var startTime = time.Now().Truncate(time.Second)
+
+// notModified sets Last-Modified header of a listing of notes and
+// responds with 304 Not Modified if the client has a fresh copy. The
+// time of the latest change of any note is used as a listing depends
+// also on notes which no longer match (e.g., after removing a tag or
+// moving a note to the trash) and on topics and tags of all notes.
+// Relative times shown on a page served from the cache are updated by
+// its script (see relativeFormats).
+func (s *server) notModified(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" || r.Form.Get("sort") == "viewed" || r.Form.Get("when") != "" {
+		// listing ordered by last view changes on every view and
+		// listings of recently created notes change with the date
+		return false
+	}
+	_, modified, err := s.db.SyncCursor()
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	if startTime.After(modified) {
+		modified = startTime
+	}
+	w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	t, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err == nil && !modified.After(t) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// askPassword asks for a new password (twice) until it is strong
+// enough (see checkPassword) and both entries match (at most three
+// times).
+func askPassword(login string, minLen int) (string, error) {
+	for i := 0; ; i++ {
+		pass, err := speakeasy.Ask("Password: ")
+		if err != nil {
+			return "", err
+		}
+		err = checkPassword(login, pass, minLen)
+		if err == nil {
+			var repeat string
+			if repeat, err = speakeasy.Ask("Retype password: "); err != nil {
+				return "", err
+			}
+			if repeat == pass {
+				return pass, nil
+			}
+			err = errors.New("passwords do not match")
+		}
+		if i == 2 {
+			return "", err
+		}
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// exportPathTags returns the topic and tags of the export path (such
+// as /topic/tag1/tag2 or /-/tag1 for notes with any topic) as used in
+// the URLs of listings. A single trailing slash is allowed.
+func exportPathTags(path string) (string, []string, error) {
+	if !strings.HasPrefix(path, "/") {
+		return "", nil, errors.New("export path must start with '/'")
+	}
+	tags := strings.Split(strings.TrimSuffix(path[1:], "/"), "/")
+	for _, tag := range tags {
+		if tag == "" {
+			return "", nil, fmt.Errorf("empty topic or tag in export path %q", path)
+		}
+	}
+	if tags[0] == "-" && len(tags) == 1 {
+		return "", nil, errors.New(`export path "/-" requires at least one tag (use "/" for all notes)`)
+	}
+	return "/" + tags[0], tags[1:], nil
+}
+
+// searchAllNotes returns all notes (not limited to queryLimit)
+// matching the search expression as entered in the search field of
+// the web page.
+func searchAllNotes(db *DB, expr string) ([]*Note, error) {
+	path := tagsURL("/", expr, "")
+	var q string
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		var err error
+		if q, err = url.QueryUnescape(path[i+3:]); err != nil {
+			return nil, err
+		}
+		path = path[:i]
+	}
+	tags, err := splitPath(path)
+	if err != nil {
+		return nil, err
+	}
+	var notes []*Note
+	for start := 0; ; start += queryLimit {
+		var (
+			page []*Note
+			err  error
+		)
+		if path == "/" || path == "/-" {
+			if q == "" {
+				return nil, errors.New("empty search expression")
+			}
+			page, err = db.FTS(q, start)
+		} else {
+			page, err = db.Notes("/"+tags[1], tags[2:], q, start, orderByCreated, false, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(page) <= queryLimit {
+			return append(notes, page...), nil
+		}
+		notes = append(notes, page[:queryLimit]...)
 	}
 }
 
@@ -224,13 +804,20 @@ func parseOptions(options string) (git bool, lang string, err error) {
 }
 
 type server struct {
-	db     *DB
-	t      TemplateExecutor
-	md     *markdown.Markdown
-	s      *sessions
-	secure bool
-	tr     func(string) string
-	dir    http.FileSystem
+	db       *DB
+	t        TemplateExecutor
+	md       *markdown.Markdown
+	s        *sessions
+	secure   bool
+	sameSite http.SameSite
+	tr       func(string) string
+	dir      http.FileSystem
+	recent   bool // show recent notes instead of the index on the home page
+	submits  *submitTokens
+	maint    *maintenance // runtime read-only mode
+	title    string       // instance name shown in page titles
+	base     string       // path prefix of all the URLs (see -base_path)
+	assets   string       // base URL of the static assets (see -static_base_url)
 }
 
 type TemplateExecutor interface {
@@ -238,39 +825,80 @@ type TemplateExecutor interface {
 }
 
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	path := r.URL.Path
-	tags := strings.Split(path, "/")
+	path := r.URL.EscapedPath()
+	tags, err := splitPath(path)
+	if err != nil {
+		s.notFound(w, r)
+		return
+	}
 	if err := r.ParseForm(); err != nil {
 		s.parseFormError(w, err)
 		return
 	}
 	if tag := r.Form.Get("tag"); tag != "" {
-		http.Redirect(w, r, tagsURL(path, tag, r.Form.Get("q")), http.StatusMovedPermanently)
+		http.Redirect(w, r, s.base+tagsURL(path, tag, r.Form.Get("q")), http.StatusMovedPermanently)
+		return
+	}
+	if s.notModified(w, r) {
 		return
 	}
 	var (
 		notes         []*Note
-		err           error
 		allTags       []string
 		activeTags    []string
 		availableTags []string
+		relatedTags   []string
+		subtopics     []string
 		isHTML        = false
 		count         = 0
 		start         = 0
 		more          = false
 	)
+	if start, err = startParam(r, *maxStart); err != nil {
+		s.error(w, s.tr("Bad request: start parameter too large"), fmt.Sprintf(s.tr("Paging is limited to the first %d notes."), *maxStart), http.StatusBadRequest)
+		return
+	}
 	if path == "/" || path == "/-" || path == "/-/" {
 		if q := r.Form.Get("q"); q != "" {
-			start, err = strconv.Atoi(r.Form.Get("start"))
-			if err != nil {
-				start = 0
+			order := orderByCreated
+			if r.Form.Get("sort") == "relevance" {
+				order = orderByRelevance
+			}
+			ctx, cancel := queryContext(r)
+			notes, err = s.db.FTSContext(ctx, q, start, order)
+			cancel()
+			if len(notes) > queryLimit {
+				more = true
+				notes = notes[:queryLimit]
+			}
+			count = len(notes)
+		} else if when := r.Form.Get("when"); path == "/" && when != "" {
+			since, ok := whenSince(when, time.Now().In(location))
+			if !ok {
+				s.error(w, s.tr("Bad request: when parameter must be today or week"), "", http.StatusBadRequest)
+				return
 			}
-			notes, err = s.db.FTS(q, start)
+			ctx, cancel := queryContext(r)
+			notes, err = s.db.NotesCreatedSinceContext(ctx, since, start)
+			cancel()
 			if len(notes) > queryLimit {
 				more = true
 				notes = notes[:queryLimit]
 			}
 			count = len(notes)
+			availableTags = tagsFromNotes(notes)
+			if availableTags == nil {
+				availableTags = make([]string, 0)
+			}
+		} else if path == "/" && s.recent {
+			ctx, cancel := queryContext(r)
+			notes, err = s.db.RecentNotesContext(ctx, queryLimit)
+			cancel()
+			count = len(notes)
+			availableTags = tagsFromNotes(notes)
+			if availableTags == nil {
+				availableTags = make([]string, 0)
+			}
 		} else {
 			notes, availableTags, err = s.TopicsAndTagsAsNotes()
 			allTags = availableTags
@@ -278,11 +906,14 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		activeTags = make([]string, 0)
 	} else {
-		start, err = strconv.Atoi(r.Form.Get("start"))
-		if err != nil {
-			start = 0
+		exclude := strings.Fields(strings.Join(r.Form["exclude"], " "))
+		order := orderByCreated
+		if r.Form.Get("sort") == "viewed" {
+			order = orderByLastViewed
 		}
-		notes, err = s.db.Notes("/"+tags[1], tags[2:], r.Form.Get("q"), start, true)
+		ctx, cancel := queryContext(r)
+		notes, err = s.db.NotesContext(ctx, "/"+tags[1], tags[2:], r.Form.Get("q"), start, order, r.Form.Get("match") == "any", exclude)
+		cancel()
 		if len(notes) > queryLimit {
 			more = true
 			notes = notes[:queryLimit]
@@ -293,35 +924,258 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			availableTags = make([]string, 0)
 		}
 		activeTags = append([]string{"/" + tags[1]}, tags[2:]...)
+		if err == nil && len(notes) > 0 {
+			queryTags := activeTags
+			if tags[1] == "-" {
+				queryTags = tags[2:]
+			}
+			var ids []interface{}
+			if ids, err = s.db.TagIDs(queryTags); err == nil {
+				relatedTags, err = s.db.RelatedTagsContext(r.Context(), ids, relatedTagsLimit)
+			}
+		}
+	}
+	if more && *maxStart > 0 && start+queryLimit > *maxStart {
+		more = false // the next page would exceed -max_start
+	}
+	if _, ok := err.(NoTagsError); ok {
+		// unknown tags in the path result in "No such notes"
+		notes, err = nil, nil
 	}
 	if allTags == nil && err == nil {
 		var topics, tags []string
 		topics, tags, err = s.db.TopicsAndTags()
-		allTags = append(topics, tags...)
+		allTags = concatTags(topics, tags)
+		if len(activeTags) > 0 && activeTags[0] != "/-" {
+			subtopics = descendantTopics(topics, activeTags[0])
+		}
 	}
 	if err != nil {
-		if _, ok := err.(NoTagsError); ok {
-			notes = nil
-		} else {
-			s.internalError(w, err)
-			return
-		}
+		s.internalError(w, err)
+		return
+	}
+	if !isHTML && (r.Form.Get("format") == "md" || strings.Contains(r.Header.Get("Accept"), "text/markdown")) {
+		s.serveMarkdown(w, notes)
+		return
+	}
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+	if !isHTML {
+		s.setEditCounts(notes)
 	}
 	if len(notes) == 0 {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		w.WriteHeader(http.StatusNotFound)
 		notes = append(notes, &Note{
 			Text:     s.tr("# No such notes"),
 			NoFooter: true,
 		})
+	} else if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		s.s.SetListing(cookie.Value, path)
 	}
-	if r.URL.RawQuery != "" {
-		path += "?" + r.URL.RawQuery
+	err = s.t.ExecuteTemplate(w, "layout.html", &Notes{path, notes, s.md, allTags, activeTags, availableTags, relatedTags, subtopics, isHTML, nil, count, start, more, false, r.Form.Get("print") != "", r.Form.Get("view") == "compact" && !isHTML, s.title})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	err = s.t.ExecuteTemplate(w, "layout.html", &Notes{path, notes, s.md, allTags, activeTags, availableTags, isHTML, nil, count, start, more})
+}
+
+// setEditCounts sets edit counts of the notes shown in the footer.
+func (s *server) setEditCounts(notes []*Note) {
+	ids := make([]int64, len(notes))
+	for i, n := range notes {
+		ids[i] = n.ID
+	}
+	edits, err := s.db.NoteEditCounts(ids)
 	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, n := range notes {
+		n.EditCount = edits[n.ID]
+	}
+}
+
+// whenSince returns the start of the period given with the when
+// parameter: today or week (the last 7 days including today).
+func whenSince(when string, now time.Time) (time.Time, bool) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch when {
+	case "today":
+		return today, true
+	case "week":
+		return today.AddDate(0, 0, -6), true
+	}
+	return time.Time{}, false
+}
+
+// errStartTooLarge is returned by startParam for start parameter
+// exceeding -max_start.
+var errStartTooLarge = errors.New("start parameter too large")
+
+// startParam returns the start parameter (offset) of a listing of
+// notes (0 if missing or invalid) or errStartTooLarge if it exceeds
+// max (unless max is 0).
+func startParam(r *http.Request, max int) (int, error) {
+	start, err := strconv.Atoi(r.Form.Get("start"))
+	if err != nil || start < 0 {
+		return 0, nil
+	}
+	if max > 0 && start > max {
+		return 0, errStartTooLarge
+	}
+	return start, nil
+}
+
+// queryContext returns the context of the request with the deadline
+// set with -query_timeout for database queries of note listings (the
+// queries are interrupted after the deadline, see DB.beginContext).
+func queryContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if *queryTimeout > 0 {
+		return context.WithTimeout(r.Context(), *queryTimeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
+// serveMarkdown writes markdown source of the notes in the export
+// format.
+func (s *server) serveMarkdown(w http.ResponseWriter, notes []*Note) {
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	if len(notes) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var b bytes.Buffer
+	if err := export(&b, notes, "", true); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if _, err := b.WriteTo(w); err != nil {
+		log.Println(err)
+	}
+}
+
+type openSearchDescription struct {
+	XMLName       xml.Name `xml:"http://a9.com/-/spec/opensearch/1.1/ OpenSearchDescription"`
+	ShortName     string
+	Description   string
+	InputEncoding string
+	URL           struct {
+		Type     string `xml:"type,attr"`
+		Template string `xml:"template,attr"`
+	} `xml:"Url"`
+}
+
+// buildInfo describes the running pns binary.
+type buildInfo struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	Revision  string `json:"revision,omitempty"`
+	RevTime   string `json:"revision_time,omitempty"`
+}
+
+// serveVersion returns as JSON the version of pns and information on
+// the build (if available) so that one may check which build is
+// deployed.
+func (s *server) serveVersion(w http.ResponseWriter, r *http.Request) {
+	info := buildInfo{Version: Version, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		info.GoVersion = bi.GoVersion
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info.Revision = setting.Value
+			case "vcs.time":
+				info.RevTime = setting.Value
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&info); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveOpenSearch serves OpenSearch description so that PNS may be
+// added as a search engine to a web browser.
+func (s *server) serveOpenSearch(w http.ResponseWriter, r *http.Request) {
+	host := *hostname
+	if host == "" || strings.Contains(host, ",") || strings.HasPrefix(host, ".") {
+		// with many hosts allowed the request host is already checked
+		host = r.Host
+	}
+	scheme := "http"
+	if s.secure {
+		scheme = "https"
+	}
+	d := openSearchDescription{ShortName: s.title, Description: "PNS (Personal note server)", InputEncoding: "UTF-8"}
+	d.URL.Type = "text/html"
+	d.URL.Template = scheme + "://" + host + s.base + "/?q={searchTerms}"
+	b, err := xml.MarshalIndent(&d, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/opensearchdescription+xml")
+	io.WriteString(w, xml.Header)
+	w.Write(b)
+}
+
+// serveFavicon serves the favicon to browsers requesting /favicon.ico
+// (so that such requests are not treated as note listings requiring
+// login).
+func (s *server) serveFavicon(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "max-age=86400")
+	s.serveStatic(w, r, "favicon.png")
+}
+
+// serveServiceWorker serves the service worker (which caches the add
+// note page for offline use) with the scope of the whole site.
+func (s *server) serveServiceWorker(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Header().Set("Service-Worker-Allowed", s.base+"/")
+	w.Header().Set("Cache-Control", "no-cache")
+	s.serveStatic(w, r, "sw.js")
+}
+
+// serveStatic serves the given file of static assets.
+func (s *server) serveStatic(w http.ResponseWriter, r *http.Request, name string) {
+	f, err := s.dir.Open("/" + name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, name, fi.ModTime(), f)
+}
+
+type manifestIcon struct {
+	Src   string `json:"src"`
+	Sizes string `json:"sizes"`
+	Type  string `json:"type"`
+}
+
+// serveManifest serves web app manifest so that PNS may be installed
+// as an application (e.g., on a phone).
+func (s *server) serveManifest(w http.ResponseWriter, r *http.Request) {
+	m := struct {
+		Name      string         `json:"name"`
+		ShortName string         `json:"short_name"`
+		StartURL  string         `json:"start_url"`
+		Display   string         `json:"display"`
+		Icons     []manifestIcon `json:"icons"`
+	}{"PNS (Personal note server)", s.title, s.base + "/", "standalone",
+		[]manifestIcon{{s.assets + "/favicon.png", "16x16", "image/png"}}}
+	w.Header().Set("Content-Type", "application/manifest+json")
+	if err := json.NewEncoder(w).Encode(&m); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
 }
 
 func (s *server) serveEdit(w http.ResponseWriter, r *http.Request) {
@@ -330,7 +1184,7 @@ func (s *server) serveEdit(w http.ResponseWriter, r *http.Request) {
 		s.notFound(w, r)
 		return
 	}
-	note, err := s.db.Note(id)
+	note, err := s.db.NoteContext(r.Context(), id)
 	if err == sql.ErrNoRows {
 		s.notFound(w, r)
 		return
@@ -338,7 +1192,8 @@ func (s *server) serveEdit(w http.ResponseWriter, r *http.Request) {
 		s.internalError(w, err)
 		return
 	}
-	ntt := append(note.Topics, note.Tags...)
+	s.setViewed(id)
+	ntt := concatTags(note.Topics, note.Tags)
 	s.editPage(w, r, note, strings.Join(ntt, " "), note.sha1sum())
 }
 
@@ -354,7 +1209,7 @@ func (s *server) editPage(w http.ResponseWriter, r *http.Request, note *Note, no
 		s.internalError(w, err)
 		return
 	}
-	tt := append(topics, tags...)
+	tt := concatTags(topics, tags)
 	noteEx := struct {
 		*Note
 		TopicsAndTagsComma string
@@ -363,7 +1218,10 @@ func (s *server) editPage(w http.ResponseWriter, r *http.Request, note *Note, no
 		Copy               bool
 		SHA1Sum            string
 		Preview            template.HTML
-	}{note, strings.Join(tt, ", "), noteTopicsAndTags, true, false, sha1sum, template.HTML(b.String())}
+		From               string
+		BackURL            string
+		Title              string
+	}{note, strings.Join(tt, ", "), noteTopicsAndTags, true, false, sha1sum, template.HTML(b.String()), r.FormValue("from"), s.listing(r), s.title}
 	err = s.t.ExecuteTemplate(w, "edit.html", noteEx)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -373,6 +1231,7 @@ func (s *server) editPage(w http.ResponseWriter, r *http.Request, note *Note, no
 
 func (s *server) serveAPIEditSubmit(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
 		s.error(w, s.tr("Method not allowed"), s.tr("Please use POST."), http.StatusMethodNotAllowed)
 		return
 	}
@@ -393,7 +1252,7 @@ func (s *server) serveAPIEditSubmit(w http.ResponseWriter, r *http.Request) {
 	case "Diff":
 		s.diff(w, r, id, text, strings.Fields(tags), false, "")
 	case "Submit":
-		s.updateNote(w, r, id, text, tags, r.PostForm.Get("sha1sum"))
+		s.updateNote(w, r, id, text, tags, r.PostForm.Get("sha1sum"), r.PostForm.Get("from"))
 	default:
 		http.Error(w, s.tr("unsupported action"), http.StatusBadRequest)
 	}
@@ -404,7 +1263,7 @@ func (s *server) serveAPIEditSubmit(w http.ResponseWriter, r *http.Request) {
 func (s *server) previewNote(w http.ResponseWriter, r *http.Request, id int64, text string, tags []string) {
 	var dbTags []string
 	if id >= 0 {
-		note, err := s.db.Note(id)
+		note, err := s.db.NoteContext(r.Context(), id)
 		if err == sql.ErrNoRows {
 			http.NotFound(w, r)
 			return
@@ -412,7 +1271,7 @@ func (s *server) previewNote(w http.ResponseWriter, r *http.Request, id int64, t
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		dbTags = append(note.Topics, note.Tags...)
+		dbTags = concatTags(note.Topics, note.Tags)
 	}
 	messages, err := s.preSubmitWarnings(tags, dbTags, id >= 0)
 	if err != nil {
@@ -427,7 +1286,7 @@ func (s *server) previewNote(w http.ResponseWriter, r *http.Request, id int64, t
 }
 
 func (s *server) diff(w http.ResponseWriter, r *http.Request, id int64, text string, tags []string, conflict bool, sha1Sum string) {
-	note, err := s.db.Note(id)
+	note, err := s.db.NoteContext(r.Context(), id)
 	if err == sql.ErrNoRows {
 		http.NotFound(w, r)
 		return
@@ -435,7 +1294,7 @@ func (s *server) diff(w http.ResponseWriter, r *http.Request, id int64, text str
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	messages, err := s.preSubmitWarnings(tags, append(note.Topics, note.Tags...), true)
+	messages, err := s.preSubmitWarnings(tags, concatTags(note.Topics, note.Tags), true)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -443,7 +1302,8 @@ func (s *server) diff(w http.ResponseWriter, r *http.Request, id int64, text str
 		messages = append([]string{s.tr(`Conflicting edits detected. Please join the changes and click "Submit" again when done.`)}, messages...)
 	}
 	var b bytes.Buffer
-	err = htmlDiff(&b, strings.Replace(note.Text, "\r\n", "\n", -1), strings.Replace(text, "\r\n", "\n", -1))
+	ignoreWhitespace := r.FormValue("ignore_whitespace") != ""
+	err = htmlDiff(&b, strings.Replace(note.Text, "\r\n", "\n", -1), strings.Replace(text, "\r\n", "\n", -1), ignoreWhitespace)
 	if err == NoDifference {
 		messages = append(messages, s.tr("No differences found."))
 	} else if err != nil {
@@ -454,10 +1314,11 @@ func (s *server) diff(w http.ResponseWriter, r *http.Request, id int64, text str
 		w.WriteHeader(http.StatusConflict)
 	}
 	data := struct {
-		Diff     template.HTML
-		Messages []string
-		SHA1Sum  string
-	}{template.HTML(b.String()), messages, sha1Sum}
+		Diff             template.HTML
+		Messages         []string
+		SHA1Sum          string
+		IgnoreWhitespace bool
+	}{template.HTML(b.String()), messages, sha1Sum, ignoreWhitespace}
 	err = s.t.ExecuteTemplate(w, "diff.html", &data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -470,6 +1331,10 @@ func (s *server) preSubmitWarnings(tags, dbTags []string, edit bool) ([]string,
 	if len(tags) == 0 {
 		messages = append(messages, s.tr("Please specify at least one topic or tag."))
 	}
+	if repeated := repeatedTags(tags); len(repeated) > 0 {
+		t := strings.Join(repeated, s.tr(`" and "`))
+		messages = append(messages, fmt.Sprintf(s.tr(`Note that the following tags/topics are repeated: "%s".`), t))
+	}
 	if len(tags) > 0 {
 		newTags, err := s.db.NewTags(tags)
 		if err != nil {
@@ -478,6 +1343,14 @@ func (s *server) preSubmitWarnings(tags, dbTags []string, edit bool) ([]string,
 		if len(newTags) > 0 {
 			newStr := strings.Join(newTags, s.tr(`" and "`))
 			messages = append(messages, fmt.Sprintf(s.tr(`Note that the following tags/topics are new: "%s".`), newStr))
+			colliding, err := s.db.CollidingTags(newTags)
+			if err != nil {
+				return nil, err
+			}
+			if len(colliding) > 0 {
+				t := strings.Join(colliding, s.tr(`" and "`))
+				messages = append(messages, fmt.Sprintf(s.tr(`Note that the following tags/topics differing only by the leading "/" already exist: "%s".`), t))
+			}
 		}
 	}
 	if edit {
@@ -494,6 +1367,21 @@ func (s *server) preSubmitWarnings(tags, dbTags []string, edit bool) ([]string,
 	return messages, nil
 }
 
+// repeatedTags returns the tags (as entered in the tag field of the
+// edit page) occurring more than once, which might be a typo as
+// repeated tags are silently merged.
+func repeatedTags(tags []string) []string {
+	var repeated []string
+	count := make(map[string]int)
+	for _, tag := range tags {
+		count[tag]++
+		if count[tag] == 2 {
+			repeated = append(repeated, tag)
+		}
+	}
+	return repeated
+}
+
 func addedRemoved(old, new []string) ([]string, []string) {
 	old = append([]string{}, old...)
 	new = append([]string{}, new...)
@@ -523,128 +1411,547 @@ func addedRemoved(old, new []string) ([]string, []string) {
 		added = append(added, new[j])
 		j++
 	}
-	return added, removed
+	return added, removed
+}
+
+func (s *server) updateNote(w http.ResponseWriter, r *http.Request, id int64, text, topicsAndTags, sha1sum, from string) {
+	if !s.beginWrite(w) {
+		return
+	}
+	defer s.maint.endWrite()
+	topics, tags := topicsAndTagsFromEditField(topicsAndTags)
+	err := s.db.updateNote(id, text, concatTags(topics, tags), sha1sum)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err == ErrNoTags {
+		http.Error(w, s.tr("Please specify at least one topic or tag."), http.StatusBadRequest)
+		return
+	} else if s.quotaError(w, err) {
+		return
+	} else if e, ok := err.(*EditConflictError); ok {
+		s.diff(w, r, id, text, strings.Fields(topicsAndTags), true, e.SHA1Sum)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	path := editRedirectionPath(topics, tags, id, from)
+	sendRedirectJSON(w, s.base+path)
+}
+
+// quotaError writes an error response and returns true if err is
+// caused by exceeding the limits set with -max_notes or
+// -max_note_size.
+func (s *server) quotaError(w http.ResponseWriter, err error) bool {
+	switch err {
+	case ErrTooManyNotes:
+		http.Error(w, s.tr("Maximum number of notes reached."), http.StatusForbidden)
+	case ErrNoteTooLong:
+		http.Error(w, s.tr("The note is too long."), http.StatusRequestEntityTooLarge)
+	default:
+		return false
+	}
+	return true
+}
+
+func sendRedirectJSON(w http.ResponseWriter, path string) {
+	data := struct {
+		RedirectLocation string `json:"redirect_location"`
+	}{path}
+	if err := json.NewEncoder(w).Encode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *server) serveAdd(w http.ResponseWriter, r *http.Request) {
+	topics, tags, err := s.db.TopicsAndTags()
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	tt := concatTags(topics, tags)
+	noteEx := struct {
+		Text               string
+		TopicsAndTagsComma string
+		NoteTopicsAndTags  string
+		Edit               bool
+		EditConflict       bool
+		Copy               bool
+		Preview            template.HTML
+		From               string
+		BackURL            string
+		SubmitToken        string
+		Title              string
+	}{"", strings.Join(tt, ", "), "", false, false, false, "", r.FormValue("from"), s.listing(r), newSubmitToken(), s.title}
+	err = s.t.ExecuteTemplate(w, "edit.html", noteEx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *server) serveCopy(w http.ResponseWriter, r *http.Request) {
+	id, err := idFromPath(r.URL.Path, "/_/copy/")
+	if err != nil {
+		s.notFound(w, r)
+		return
+	}
+	note, err := s.db.NoteContext(r.Context(), id)
+	if err == sql.ErrNoRows {
+		s.notFound(w, r)
+		return
+	} else if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	ntt := concatTags(note.Topics, note.Tags)
+
+	topics, tags, err := s.db.TopicsAndTags()
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	tt := concatTags(topics, tags)
+	noteEx := struct {
+		*Note
+		TopicsAndTagsComma string
+		NoteTopicsAndTags  string
+		Edit               bool
+		EditConflict       bool
+		Copy               bool
+		From               string
+		BackURL            string
+		SubmitToken        string
+		Title              string
+	}{note, strings.Join(tt, ", "), strings.Join(ntt, " "), false, false, true, r.FormValue("from"), s.listing(r), newSubmitToken(), s.title}
+	err = s.t.ExecuteTemplate(w, "edit.html", noteEx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *server) serveAPIAddSubmit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		s.error(w, s.tr("Method not allowed"), s.tr("Please use POST."), http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		http.Error(w, s.tr("Bad request: error parsing form")+": "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	text := r.PostForm.Get("text")
+	tags := r.PostForm.Get("tag")
+	switch r.PostForm.Get("action") {
+	case "Preview":
+		s.previewNote(w, r, -1, text, strings.Fields(tags))
+	case "Submit":
+		copiedFrom, _ := strconv.ParseInt(r.PostForm.Get("copied_from"), 10, 64)
+		s.addNote(w, r, text, tags, r.PostForm.Get("from"), copiedFrom, r.PostForm.Get("submit_token"))
+	default:
+		http.Error(w, s.tr("unsupported action"), http.StatusBadRequest)
+	}
+}
+
+// addNote adds a note submitted with the add note form. A repeated
+// submit of the same content with the same submit token (e.g., after
+// a double click) redirects to the note added first instead of adding
+// another one.
+func (s *server) addNote(w http.ResponseWriter, r *http.Request, text, topicsAndTags, from string, copiedFrom int64, token string) {
+	if !s.beginWrite(w) {
+		return
+	}
+	defer s.maint.endWrite()
+	topics, tags := topicsAndTagsFromEditField(topicsAndTags)
+	text, topics, tags = mergeFrontMatter(text, topics, tags, *keepFront)
+	key := submitKey(token, text, strings.Join(concatTags(topics, tags), " "))
+	if id := s.submits.Begin(key); id > 0 {
+		sendRedirectJSON(w, s.base+editRedirectionPath(topics, tags, id, from))
+		return
+	}
+	id, err := s.db.addNote(text, concatTags(topics, tags), copiedFrom)
+	s.submits.End(key, id)
+	if err == ErrNoTags {
+		http.Error(w, s.tr("Please specify at least one topic or tag."), http.StatusBadRequest)
+		return
+	} else if s.quotaError(w, err) {
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	path := editRedirectionPath(topics, tags, id, from)
+	sendRedirectJSON(w, s.base+path)
+}
+
+// serveAPIQuickAdd adds a note from a text/plain request body. The
+// first line of the body is the list of topics and tags (as in the
+// tag field of the edit page) and the rest is the text of the note.
+// The ID of the new note is returned as JSON.
+func (s *server) serveAPIQuickAdd(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, s.tr("Method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, s.tr("Bad request: error reading body")+": "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	topicsAndTags, text := string(b), ""
+	if i := strings.IndexByte(topicsAndTags, '\n'); i >= 0 {
+		topicsAndTags, text = topicsAndTags[:i], topicsAndTags[i+1:]
+	}
+	topics, tags := topicsAndTagsFromEditField(topicsAndTags)
+	text, topics, tags = mergeFrontMatter(text, topics, tags, *keepFront)
+	if !s.beginWrite(w) {
+		return
+	}
+	defer s.maint.endWrite()
+	id, err := s.db.addNote(text, concatTags(topics, tags), 0)
+	if err == ErrNoTags {
+		http.Error(w, s.tr("Please specify at least one topic or tag."), http.StatusBadRequest)
+		return
+	} else if s.quotaError(w, err) {
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		ID int64 `json:"id"`
+	}{id}
+	if err := json.NewEncoder(w).Encode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+type apiNote struct {
+	ID       int64     `json:"id"`
+	Topics   []string  `json:"topics"`
+	Tags     []string  `json:"tags"`
+	Created  time.Time `json:"created"`
+	Modified time.Time `json:"modified"`
+	Text     string    `json:"text"`
+}
+
+// serveAPIRender renders markdown text given as the request body
+// (e.g., for a live preview in an external editor) and returns the
+// resulting HTML fragment.
+func (s *server) serveAPIRender(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, s.tr("Method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, s.tr("Bad request: error reading body")+": "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var buf bytes.Buffer
+	if err := s.md.Render(&buf, []byte(expandStatic(string(b)))); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+// serveAPIActivity returns as JSON the number of notes created on
+// each day from the from parameter to the to parameter (inclusive,
+// dates such as 2006-01-02), by default in the last year.
+func (s *server) serveAPIActivity(w http.ResponseWriter, r *http.Request) {
+	from, to, err := activityRange(r.FormValue("from"), r.FormValue("to"), time.Now().In(location))
+	if err != nil {
+		http.Error(w, s.tr("Bad request: from and to parameters must be dates such as 2006-01-02"), http.StatusBadRequest)
+		return
+	}
+	days, err := s.db.ActivityByDayContext(r.Context(), from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(days); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
 }
 
-func (s *server) updateNote(w http.ResponseWriter, r *http.Request, id int64, text, topicsAndTags, sha1sum string) {
-	topics, tags := topicsAndTagsFromEditField(topicsAndTags)
-	err := s.db.updateNote(id, text, append(topics, tags...), sha1sum)
-	if err == ErrNoTags {
-		http.Error(w, s.tr("Please specify at least one topic or tag."), http.StatusBadRequest)
+// activityRange returns the start of the from day and the end of the
+// to day (dates such as 2006-01-02), by default the last 365 days
+// ending today.
+func activityRange(fromStr, toStr string, now time.Time) (time.Time, time.Time, error) {
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	var err error
+	if toStr != "" {
+		to, err = time.ParseInLocation("2006-01-02", toStr, now.Location())
+	}
+	from := to.AddDate(0, 0, -364)
+	if fromStr != "" && err == nil {
+		from, err = time.ParseInLocation("2006-01-02", fromStr, now.Location())
+	}
+	if err == nil && from.After(to) {
+		err = errors.New("from after to")
+	}
+	return from, to.AddDate(0, 0, 1), err
+}
+
+// serveAPINotes returns as JSON notes with IDs in the range given by
+// min and max parameters (inclusive) so that a client may fetch all
+// the notes in batches.
+func (s *server) serveAPINotes(w http.ResponseWriter, r *http.Request) {
+	minID, err := strconv.ParseInt(r.FormValue("min"), 10, 64)
+	if err != nil {
+		http.Error(w, s.tr("Bad request: min and max parameters expected"), http.StatusBadRequest)
 		return
-	} else if e, ok := err.(*EditConflictError); ok {
-		s.diff(w, r, id, text, strings.Fields(topicsAndTags), true, e.SHA1Sum)
+	}
+	maxID, err := strconv.ParseInt(r.FormValue("max"), 10, 64)
+	if err != nil || maxID < minID {
+		http.Error(w, s.tr("Bad request: min and max parameters expected"), http.StatusBadRequest)
 		return
-	} else if err != nil {
+	}
+	notes, err := s.db.NotesByIDRangeContext(r.Context(), minID, maxID)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	path := editRedirectionPath(topics, tags, id)
-	sendRedirectJSON(w, path)
+	data := make([]apiNote, len(notes))
+	for i, n := range notes {
+		data[i] = apiNote{n.ID, n.Topics, n.Tags, n.Created, n.Modified, n.Text}
+		if data[i].Topics == nil {
+			data[i].Topics = make([]string, 0)
+		}
+		if data[i].Tags == nil {
+			data[i].Tags = make([]string, 0)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
 }
 
-func sendRedirectJSON(w http.ResponseWriter, path string) {
+// serveAPISync returns as JSON the highest note ID and the latest
+// modification time so that a client may fetch only changed notes.
+func (s *server) serveAPISync(w http.ResponseWriter, r *http.Request) {
+	maxID, modified, err := s.db.SyncCursor()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	data := struct {
-		RedirectLocation string `json:"redirect_location"`
-	}{path}
+		MaxID          int64     `json:"max_id"`
+		LatestModified time.Time `json:"latest_modified"`
+	}{maxID, modified}
+	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(&data); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
-func (s *server) serveAdd(w http.ResponseWriter, r *http.Request) {
+// serveAPIBackup sends a consistent copy of the database file (see
+// DB.BackupWithoutUsers) as an attachment.
+func (s *server) serveAPIBackup(w http.ResponseWriter, r *http.Request) {
+	dir, err := ioutil.TempDir("", "pns-backup")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "backup.db")
+	if err = s.db.BackupWithoutUsers(filename); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="pns-%s.db"`, time.Now().Format("20060102-150405")))
+	if _, err = io.Copy(w, f); err != nil {
+		log.Println("failed to send backup:", err)
+	}
+}
+
+// serveAPIVocabulary returns as JSON names of all the topics and tags
+// (e.g., for autocompletion in an external editor).  ETag and
+// Last-Modified headers are set so that a client polling for changes
+// may use conditional requests.
+func (s *server) serveAPIVocabulary(w http.ResponseWriter, r *http.Request) {
+	_, modified, err := s.db.SyncCursor()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	topics, tags, err := s.db.TopicsAndTags()
 	if err != nil {
-		s.internalError(w, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	tt := append(topics, tags...)
-	noteEx := struct {
-		Text               string
-		TopicsAndTagsComma string
-		NoteTopicsAndTags  string
-		Edit               bool
-		EditConflict       bool
-		Copy               bool
-		Preview            template.HTML
-	}{"", strings.Join(tt, ", "), "", false, false, false, ""}
-	err = s.t.ExecuteTemplate(w, "edit.html", noteEx)
+	if topics == nil {
+		topics = make([]string, 0)
+	}
+	if tags == nil {
+		tags = make([]string, 0)
+	}
+	data := struct {
+		Topics []string `json:"topics"`
+		Tags   []string `json:"tags"`
+	}{topics, tags}
+	b, err := json.Marshal(&data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	h := sha1.Sum(b)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", `"`+hex.EncodeToString(h[:])+`"`)
+	http.ServeContent(w, r, "", modified, bytes.NewReader(b))
 }
 
-func (s *server) serveCopy(w http.ResponseWriter, r *http.Request) {
-	id, err := idFromPath(r.URL.Path, "/_/copy/")
+// serveDelete moves the note to the trash and redirects to the trash
+// page so that the note may be easily restored.
+func (s *server) serveDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		s.error(w, s.tr("Method not allowed"), s.tr("Please use POST."), http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := idFromPath(r.URL.Path, "/_/delete/")
 	if err != nil {
 		s.notFound(w, r)
 		return
 	}
-	note, err := s.db.Note(id)
-	if err == sql.ErrNoRows {
+	if !s.beginWrite(w) {
+		return
+	}
+	defer s.maint.endWrite()
+	if err := s.db.DeleteNote(id); err == sql.ErrNoRows {
 		s.notFound(w, r)
 		return
 	} else if err != nil {
 		s.internalError(w, err)
 		return
 	}
-	ntt := append(note.Topics, note.Tags...)
+	http.Redirect(w, r, s.base+"/_/trash", http.StatusSeeOther)
+}
 
-	topics, tags, err := s.db.TopicsAndTags()
+func (s *server) serveRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		s.error(w, s.tr("Method not allowed"), s.tr("Please use POST."), http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := idFromPath(r.URL.Path, "/_/restore/")
 	if err != nil {
+		s.notFound(w, r)
+		return
+	}
+	if !s.beginWrite(w) {
+		return
+	}
+	defer s.maint.endWrite()
+	if err := s.db.RestoreNote(id); err == sql.ErrNoRows {
+		s.notFound(w, r)
+		return
+	} else if err != nil {
 		s.internalError(w, err)
 		return
 	}
-	tt := append(topics, tags...)
-	noteEx := struct {
-		*Note
-		TopicsAndTagsComma string
-		NoteTopicsAndTags  string
-		Edit               bool
-		EditConflict       bool
-		Copy               bool
-	}{note, strings.Join(tt, ", "), strings.Join(ntt, " "), false, false, true}
-	err = s.t.ExecuteTemplate(w, "edit.html", noteEx)
+	http.Redirect(w, r, s.base+"/_/trash", http.StatusSeeOther)
+}
+
+func (s *server) serveTrash(w http.ResponseWriter, r *http.Request) {
+	notes, err := s.db.TrashNotesContext(r.Context())
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	topics, tags, err := s.db.TopicsAndTags()
 	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	if len(notes) == 0 {
+		notes = append(notes, &Note{
+			Text:     s.tr("# Trash is empty"),
+			NoFooter: true,
+		})
+	}
+	n := &Notes{URL: "/", Notes: notes, md: s.md, AllTags: concatTags(topics, tags),
+		ActiveTags: []string{}, AvailableTags: []string{}, Trash: true, Title: s.title}
+	if err = s.t.ExecuteTemplate(w, "layout.html", n); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
-func (s *server) serveAPIAddSubmit(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		s.error(w, s.tr("Method not allowed"), s.tr("Please use POST."), http.StatusMethodNotAllowed)
+// serveNote serves the page of a single note. The URL is the note ID
+// optionally followed by a hyphen and the slug of the note (which is
+// ignored, see Note.Permalink).
+func (s *server) serveNote(w http.ResponseWriter, r *http.Request) {
+	// the slug following the ID is ignored (see Note.Permalink)
+	path := r.URL.Path
+	if i := strings.IndexByte(path, '-'); i >= 0 {
+		path = path[:i]
+	}
+	id, err := idFromPath(path, "/_/note/")
+	if err != nil {
+		s.notFound(w, r)
 		return
 	}
-	if err := r.ParseMultipartForm(1 << 20); err != nil {
-		http.Error(w, s.tr("Bad request: error parsing form")+": "+err.Error(), http.StatusBadRequest)
+	note, err := s.db.NoteContext(r.Context(), id)
+	if err == sql.ErrNoRows {
+		s.notFound(w, r)
+		return
+	} else if err != nil {
+		s.internalError(w, err)
 		return
 	}
-	text := r.PostForm.Get("text")
-	tags := r.PostForm.Get("tag")
-	switch r.PostForm.Get("action") {
-	case "Preview":
-		s.previewNote(w, r, -1, text, strings.Fields(tags))
-	case "Submit":
-		s.addNote(w, r, text, tags)
-	default:
-		http.Error(w, s.tr("unsupported action"), http.StatusBadRequest)
+	s.setViewed(id)
+	topics, tags, err := s.db.TopicsAndTags()
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	n := &Notes{URL: "/", Notes: []*Note{note}, md: s.md, AllTags: concatTags(topics, tags),
+		ActiveTags: []string{}, AvailableTags: []string{}, Title: s.title}
+	if err = s.t.ExecuteTemplate(w, "layout.html", n); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 }
 
-func (s *server) addNote(w http.ResponseWriter, r *http.Request, text, topicsAndTags string) {
-	topics, tags := topicsAndTagsFromEditField(topicsAndTags)
-	id, err := s.db.addNote(text, append(topics, tags...))
-	if err == ErrNoTags {
-		http.Error(w, s.tr("Please specify at least one topic or tag."), http.StatusBadRequest)
+// serveShortLink redirects the stable link of a note (see
+// Note.ShortLink) to the page of the note.
+func (s *server) serveShortLink(w http.ResponseWriter, r *http.Request) {
+	id, err := idFromPath(r.URL.Path, "/_/n/")
+	if err != nil {
+		s.notFound(w, r)
+		return
+	}
+	note, err := s.db.NoteContext(r.Context(), id)
+	if err == sql.ErrNoRows {
+		s.notFound(w, r)
 		return
 	} else if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.internalError(w, err)
 		return
 	}
-	path := editRedirectionPath(topics, tags, id)
-	sendRedirectJSON(w, path)
+	http.Redirect(w, r, s.base+note.Permalink(), http.StatusFound)
 }
 
 var errorTemplate = template.Must(template.New("tags").Parse("<h1>{{.Title}}</h1><p>{{.Text}}</p>"))
@@ -654,7 +1961,7 @@ func (s *server) error(w http.ResponseWriter, title, text string, code int) {
 	var b bytes.Buffer
 	errorTemplate.Execute(&b, &struct{ Title, Text string }{title, text})
 	n := &Note{Text: b.String(), NoFooter: true}
-	err := s.t.ExecuteTemplate(w, "layout.html", &Notes{"/", []*Note{n}, s.md, []string{}, []string{}, []string{}, true, nil, 0, 0, false})
+	err := s.t.ExecuteTemplate(w, "layout.html", &Notes{"/", []*Note{n}, s.md, []string{}, []string{}, []string{}, nil, nil, true, nil, 0, 0, false, false, false, false, s.title})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -673,17 +1980,34 @@ func (s *server) internalError(w http.ResponseWriter, err error) {
 	s.error(w, s.tr("Internal server error"), err.Error(), http.StatusInternalServerError)
 }
 
-func editRedirectionPath(topics, tags []string, id int64) string {
+// editRedirectionPath returns path to the note after it was added or
+// edited. The topic of the path from which the edit was started
+// (from) is used if the note still has this topic.
+func editRedirectionPath(topics, tags []string, id int64, from string) string {
 	var topic string
 	if len(topics) > 0 {
 		topic = topics[0]
+		if t := topicFromPath(from); t != "" {
+			for _, s := range topics {
+				if s == t {
+					topic = t
+				}
+			}
+		}
 	} else if len(tags) > 0 {
 		topic = "/-"
 	} else {
 		topic = "/"
 	}
+	if topic != "/" {
+		topic = topicPath(topic)
+	}
 	if len(tags) > 0 {
-		return fmt.Sprintf("%s/%s#%d", topic, strings.Join(tags, "/"), id)
+		escaped := make([]string, len(tags))
+		for i, tag := range tags {
+			escaped[i] = url.PathEscape(tag)
+		}
+		return fmt.Sprintf("%s/%s#%d", topic, strings.Join(escaped, "/"), id)
 	} else if topic != "/" {
 		return fmt.Sprintf("%s#%d", topic, id)
 	} else {
@@ -691,14 +2015,31 @@ func editRedirectionPath(topics, tags []string, id int64) string {
 	}
 }
 
+// checkUser removes the session and returns ErrAuth if the account of
+// its user was disabled (e.g., with -disable while pns is running).
+func (s *server) checkUser(sid string) error {
+	disabled, err := s.db.UserDisabled(s.s.Login(sid))
+	if err != nil {
+		return err
+	}
+	if disabled {
+		s.s.Remove(sid)
+		return ErrAuth
+	}
+	return nil
+}
+
 func (s *server) authenticate(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		cookie, err := r.Cookie(sessionCookieName)
 		if err == nil {
-			var extend bool
-			if extend, err = s.s.CheckSession(cookie.Value, sessionDuration*time.Second); err == nil {
-				if extend {
-					s.setSessionCookie(w, cookie.Value, 2*sessionDuration)
+			var extend time.Duration
+			if extend, err = s.s.CheckSession(cookie.Value); err == nil {
+				err = s.checkUser(cookie.Value)
+			}
+			if err == nil {
+				if extend > 0 {
+					s.setSessionCookie(w, cookie.Value, 2*int(extend/time.Second))
 				}
 				h(w, r)
 				return
@@ -713,6 +2054,14 @@ func (s *server) authenticate(h http.HandlerFunc) http.HandlerFunc {
 			}
 			return
 		}
+		if api && wantsJSON(r) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			if _, err := io.WriteString(w, `{"error":"unauthorized"}`+"\n"); err != nil {
+				log.Println(err)
+			}
+			return
+		}
 		if api {
 			w.WriteHeader(http.StatusUnauthorized)
 		}
@@ -724,8 +2073,17 @@ func (s *server) authenticate(h http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// wantsJSON reports whether the request accepts JSON responses and
+// is not an XMLHttpRequest from the web interface (which expects the
+// login form fragment on 401).
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json") &&
+		r.Header.Get("X-Requested-With") != "XMLHttpRequest"
+}
+
 func (s *server) serveLogin(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
 		s.error(w, s.tr("Method not allowed"), s.tr("Please use POST."), http.StatusMethodNotAllowed)
 		return
 	}
@@ -736,26 +2094,36 @@ func (s *server) serveLogin(w http.ResponseWriter, r *http.Request) {
 	login := r.PostForm.Get("login")
 	password := r.PostForm.Get("password")
 	redirect := r.PostForm.Get("redirect")
-	if err := s.db.AuthenticateUser(login, []byte(password)); err != nil {
-		if err == ErrAuth {
+	err := s.authenticateUser(login, password, r.PostForm.Get("code"))
+	if err != nil {
+		if err == ErrTOTPRequired {
+			w.WriteHeader(http.StatusUnauthorized)
+			s.loginPage(w, r, redirect, s.tr("Please enter the authentication code."), true)
+		} else if err == ErrAuth {
 			w.WriteHeader(http.StatusUnauthorized)
 			s.loginPage(w, r, redirect, s.tr("Incorrect login or password."), true)
+		} else if err == ErrMaintenance {
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			s.loginPage(w, r, redirect, s.tr("Maintenance in progress, logging in is not possible now. Please try again later."), true)
 		} else {
 			s.internalError(w, err)
 		}
 		return
 	}
-	sid, err := s.s.NewSession(sessionDuration * time.Second)
+	d := loginSessionDuration(r)
+	sid, err := s.s.NewSession(login, d)
 	if err != nil {
 		s.internalError(w, err)
 		return
 	}
-	s.setSessionCookie(w, sid, 2*sessionDuration)
-	http.Redirect(w, r, redirect, http.StatusSeeOther)
+	s.setSessionCookie(w, sid, 2*int(d/time.Second))
+	http.Redirect(w, r, s.base+redirect, http.StatusSeeOther)
 }
 
 func (s *server) serveAPILogin(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
 		http.Error(w, s.tr("Method not allowed"), http.StatusMethodNotAllowed)
 		return
 	}
@@ -765,11 +2133,19 @@ func (s *server) serveAPILogin(w http.ResponseWriter, r *http.Request) {
 	}
 	login := r.PostForm.Get("login")
 	password := r.PostForm.Get("password")
-	if err := s.db.AuthenticateUser(login, []byte(password)); err != nil {
+	err := s.authenticateUser(login, password, r.PostForm.Get("code"))
+	if err != nil {
 		var e string
-		if err == ErrAuth {
+		if err == ErrTOTPRequired {
+			e = s.tr("Please enter the authentication code.")
+			w.WriteHeader(http.StatusUnauthorized)
+		} else if err == ErrAuth {
 			e = s.tr("Incorrect login or password.")
 			w.WriteHeader(http.StatusUnauthorized)
+		} else if err == ErrMaintenance {
+			e = s.tr("Maintenance in progress, logging in is not possible now. Please try again later.")
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusServiceUnavailable)
 		} else {
 			e = err.Error()
 			w.WriteHeader(http.StatusInternalServerError)
@@ -780,18 +2156,39 @@ func (s *server) serveAPILogin(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	sid, err := s.s.NewSession(sessionDuration * time.Second)
+	d := loginSessionDuration(r)
+	sid, err := s.s.NewSession(login, d)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	s.setSessionCookie(w, sid, 2*sessionDuration)
+	s.setSessionCookie(w, sid, 2*int(d/time.Second))
 	w.WriteHeader(http.StatusOK) // for status logging to work properly
 }
 
+// listing returns URL of the last notes listing shown in the session
+// of the request.
+func (s *server) listing(r *http.Request) string {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return ""
+	}
+	return s.s.Listing(cookie.Value)
+}
+
+// loginSessionDuration returns the duration of a session created on
+// login which is longer (see -remember) if "remember me" was checked.
+func loginSessionDuration(r *http.Request) time.Duration {
+	d := sessionDuration * time.Second
+	if r.PostForm.Get("remember") != "" && *remember > d {
+		d = *remember
+	}
+	return d
+}
+
 func (s *server) setSessionCookie(w http.ResponseWriter, sid string, duration int) {
 	expires := time.Now().Add(time.Duration(duration) * time.Second)
-	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Path: "/", Value: sid, MaxAge: duration, Expires: expires, Secure: s.secure})
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Path: s.base + "/", Value: sid, MaxAge: duration, Expires: expires, Secure: s.secure, SameSite: s.sameSite})
 }
 
 func (s *server) loginPage(w http.ResponseWriter, r *http.Request, path, msg string, fullPage bool) {
@@ -799,13 +2196,90 @@ func (s *server) loginPage(w http.ResponseWriter, r *http.Request, path, msg str
 	if !fullPage {
 		t = "loginapi.html"
 	}
-	err := s.t.ExecuteTemplate(w, t, &struct{ Redirect, Message string }{path, msg})
+	err := s.t.ExecuteTemplate(w, t, &struct{ Redirect, Message, Title string }{path, msg, s.title})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
+var sessionsTemplate = template.Must(template.New("sessions").Parse(`<h1>{{.Title}}</h1>
+<table>
+<tr><th>{{.Created}}</th><th>{{.Used}}</th><th>{{.Expires}}</th><th></th></tr>
+{{range .Sessions}}<tr><td>{{$.Date .Created}}</td><td>{{$.Date .Used}}</td><td>{{$.Date .Expires}}</td><td>
+<form action="{{$.Base}}/_/sessions/revoke" method="post" class="inline">
+<input type="hidden" name="handle" value="{{.Handle}}"></input>
+<input class="pseudo button" type="submit" value="{{$.Revoke}}"></input>
+</form>{{if .Current}} ({{$.Current}}){{end}}</td></tr>
+{{end}}</table>
+`))
+
+// serveSessions serves the page listing active sessions of the user
+// (so that one may check whether one is logged in elsewhere) with
+// buttons to revoke them.
+func (s *server) serveSessions(w http.ResponseWriter, r *http.Request) {
+	var current string
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		current = cookie.Value
+	}
+	var b bytes.Buffer
+	err := sessionsTemplate.Execute(&b, &struct {
+		Title, Created, Used, Expires, Revoke, Current, Base string
+		Sessions                                             []SessionInfo
+		Date                                                 func(time.Time) string
+	}{s.tr("Sessions"), s.tr("Created"), s.tr("Last used"), s.tr("Expires"), s.tr("Revoke"), s.tr("current session"), s.base,
+		s.s.List(s.s.Login(current), current), func(t time.Time) string { return t.In(location).Format("2006-01-02 15:04") }})
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	n := &Note{Text: b.String(), NoFooter: true}
+	err = s.t.ExecuteTemplate(w, "layout.html", &Notes{"/", []*Note{n}, s.md, []string{}, []string{}, []string{}, nil, nil, true, nil, 0, 0, false, false, false, false, s.title})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveRevokeSession removes the session of the user with the given
+// handle (see SessionInfo) and redirects back to the list of sessions.
+func (s *server) serveRevokeSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		s.error(w, s.tr("Method not allowed"), s.tr("Please use POST."), http.StatusMethodNotAllowed)
+		return
+	}
+	var login string
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		login = s.s.Login(cookie.Value)
+	}
+	if !s.s.RemoveHandle(login, r.PostFormValue("handle")) {
+		s.notFound(w, r)
+		return
+	}
+	http.Redirect(w, r, s.base+"/_/sessions", http.StatusSeeOther)
+}
+
+// serveAPIClearSessions logs out all the users (including the one
+// making the request), e.g., when a session cookie might have leaked.
+// The number of removed sessions is returned as JSON.
+func (s *server) serveAPIClearSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, s.tr("Method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	n := s.s.Clear()
+	log.Printf("cleared %d sessions", n)
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Path: s.base + "/", MaxAge: -1, Secure: s.secure, SameSite: s.sameSite})
+	data := struct {
+		Cleared int `json:"cleared"`
+	}{n}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func (s *server) serveLogout(w http.ResponseWriter, r *http.Request) {
 	cookie, err := r.Cookie(sessionCookieName)
 	if err != nil {
@@ -813,7 +2287,7 @@ func (s *server) serveLogout(w http.ResponseWriter, r *http.Request) {
 	} else {
 		s.s.Remove(cookie.Value)
 	}
-	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Path: "/", MaxAge: -1, Secure: s.secure})
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Path: s.base + "/", MaxAge: -1, Secure: s.secure, SameSite: s.sameSite})
 	path := strings.TrimPrefix(r.URL.Path, "/_/logout")
 	if len(path) == len(r.URL.Path) || path == "" {
 		path = "/"
@@ -821,46 +2295,155 @@ func (s *server) serveLogout(w http.ResponseWriter, r *http.Request) {
 	if r.URL.RawQuery != "" {
 		path += "?" + r.URL.RawQuery
 	}
-	http.Redirect(w, r, path, http.StatusSeeOther)
+	http.Redirect(w, r, s.base+path, http.StatusSeeOther)
 }
 
-var ErrPrefixNotFound = errors.New("prefix not found")
+var (
+	ErrPrefixNotFound = errors.New("prefix not found")
+	ErrInvalidID      = errors.New("invalid note ID in path")
+)
 
+// idFromPath returns note ID following the prefix in the path. A
+// single trailing slash is allowed, any other content (such as further
+// path segments, signs or whitespace) results in ErrInvalidID.
 func idFromPath(path, prefix string) (int64, error) {
 	idStr := strings.TrimPrefix(path, prefix)
 	if len(idStr) == len(path) {
 		return 0, ErrPrefixNotFound
 	}
-	return strconv.ParseInt(idStr, 10, 64)
+	idStr = strings.TrimSuffix(idStr, "/")
+	if idStr == "" {
+		return 0, ErrInvalidID
+	}
+	for i := 0; i < len(idStr); i++ {
+		if idStr[i] < '0' || idStr[i] > '9' {
+			return 0, ErrInvalidID
+		}
+	}
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidID
+	}
+	return id, nil
 }
 
 type hostChecker struct {
-	hostName  string
-	withColon bool
-	handler   http.Handler
+	hosts   []allowedHost
+	handler http.Handler
 }
 
-func newHostChecker(hostName string, handler http.Handler) *hostChecker {
-	withColon := strings.Index(hostName, ":") >= 0
-	return &hostChecker{hostName, withColon, handler}
+type allowedHost struct {
+	name      string // with the leading dot for a suffix pattern
+	port      string
+	withColon bool // port is also compared
+	suffix    bool // name is a suffix pattern such as ".example.com"
 }
 
-func (hc *hostChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	h := r.Host
-	if hc.withColon {
-		if h == hc.hostName {
-			hc.handler.ServeHTTP(w, r)
-		} else {
-			http.NotFound(w, r)
+// newHostChecker returns handler which rejects requests with host
+// other than one of comma separated host names (with optional port).
+// Host name starting with a dot (such as .example.com) matches any
+// subdomain.
+func newHostChecker(hostNames string, handler http.Handler) (*hostChecker, error) {
+	var hosts []allowedHost
+	for _, name := range strings.Split(hostNames, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
 		}
-		return
+		a, err := parseAllowedHost(name)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, a)
 	}
-	if i := strings.Index(h, ":"); i >= 0 {
-		h = h[:i]
+	return &hostChecker{hosts, handler}, nil
+}
+
+func parseAllowedHost(name string) (allowedHost, error) {
+	a := allowedHost{name: name, withColon: strings.Index(name, ":") >= 0}
+	if strings.Contains(name, "*") {
+		return a, fmt.Errorf("unexpected %q in host %q (use leading dot such as .example.com to match subdomains)", "*", name)
+	}
+	if !strings.HasPrefix(name, ".") {
+		return a, nil
+	}
+	a.suffix = true
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		a.name, a.port = name[:i], name[i+1:]
+		if _, err := strconv.ParseUint(a.port, 10, 16); err != nil {
+			return a, fmt.Errorf("invalid port in host pattern %q", name)
+		}
+	}
+	for _, label := range strings.Split(a.name[1:], ".") {
+		if label == "" || strings.Trim(label, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-") != "" {
+			return a, fmt.Errorf("invalid host pattern %q", name)
+		}
 	}
-	if h == hc.hostName {
+	return a, nil
+}
+
+func (hc *hostChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if hc.allowed(r.Host) {
 		hc.handler.ServeHTTP(w, r)
 	} else {
 		http.NotFound(w, r)
 	}
 }
+
+// allowed reports whether host (with optional port) matches any of the
+// allowed hosts.
+func (hc *hostChecker) allowed(host string) bool {
+	h, port := host, ""
+	if i := strings.Index(h, ":"); i >= 0 {
+		h, port = h[:i], h[i+1:]
+	}
+	for _, a := range hc.hosts {
+		switch {
+		case a.suffix:
+			if strings.HasSuffix(h, a.name) && len(h) > len(a.name) && (!a.withColon || port == a.port) {
+				return true
+			}
+		case a.withColon:
+			if host == a.name {
+				return true
+			}
+		default:
+			if h == a.name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cleanBasePath returns the path prefix given with -base_path without
+// the trailing slash ("" for the root).
+func cleanBasePath(p string) (string, error) {
+	p = strings.TrimRight(p, "/")
+	if p == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(p, "/") || strings.ContainsAny(p, "?#") || path.Clean(p) != p {
+		return "", fmt.Errorf("invalid path %q (expected such as /notes)", p)
+	}
+	return p, nil
+}
+
+// basePathHandler serves requests under the base path (see
+// -base_path) with the base path removed from the URL.
+type basePathHandler struct {
+	base    string
+	handler http.Handler
+}
+
+func (h *basePathHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == h.base {
+		http.Redirect(w, r, h.base+"/", http.StatusMovedPermanently)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, h.base+"/") {
+		http.NotFound(w, r)
+		return
+	}
+	http.StripPrefix(h.base, h.handler).ServeHTTP(w, r)
+}
@@ -0,0 +1,133 @@
+// Copyright 2016 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// maintenance is the runtime read-only mode (e.g., for the time of a
+// backup). Writes hold the read lock so that enabling the mode waits
+// for the writes in progress.
+type maintenance struct {
+	mu sync.RWMutex
+	on bool
+}
+
+// Set enables or disables the maintenance mode. When enabling it
+// returns after all the writes in progress are finished.
+func (m *maintenance) Set(on bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.on = on
+}
+
+// Toggle switches the maintenance mode and returns the new state.
+func (m *maintenance) Toggle() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.on = !m.on
+	return m.on
+}
+
+func (m *maintenance) On() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.on
+}
+
+// beginWrite reports whether a write may be started, if so endWrite
+// must be called after the write.
+func (m *maintenance) beginWrite() bool {
+	m.mu.RLock()
+	if m.on {
+		m.mu.RUnlock()
+		return false
+	}
+	return true
+}
+
+func (m *maintenance) endWrite() {
+	m.mu.RUnlock()
+}
+
+// beginWrite is like maintenance.beginWrite but it also replies with
+// 503 Service Unavailable in the maintenance mode.
+func (s *server) beginWrite(w http.ResponseWriter) bool {
+	if s.maint.beginWrite() {
+		return true
+	}
+	w.Header().Set("Retry-After", "60")
+	http.Error(w, s.tr("Maintenance in progress, notes cannot be modified now. Please try again later."), http.StatusServiceUnavailable)
+	return false
+}
+
+// ErrMaintenance is returned by server.authenticateUser in the
+// maintenance mode.
+var ErrMaintenance = errors.New("maintenance in progress")
+
+// authenticateUser checks the password and the TOTP code of the user
+// (see DB.AuthenticateUser and DB.VerifyTOTP). As failed attempts and
+// used codes are recorded in the database ErrMaintenance is returned
+// in the maintenance mode instead.
+func (s *server) authenticateUser(login, password, code string) error {
+	if !s.maint.beginWrite() {
+		return ErrMaintenance
+	}
+	defer s.maint.endWrite()
+	err := s.db.AuthenticateUser(login, []byte(password))
+	if err == nil {
+		err = s.db.VerifyTOTP(login, code)
+	}
+	return err
+}
+
+// setViewed records that the note was viewed unless in the
+// maintenance mode (as it is also a write).
+func (s *server) setViewed(id int64) {
+	if !s.maint.beginWrite() {
+		return
+	}
+	defer s.maint.endWrite()
+	if err := s.db.SetViewed(id); err != nil {
+		log.Println(err)
+	}
+}
+
+// serveAPIMaintenance enables (on=true), disables (on=false) or
+// toggles (no on parameter) the maintenance mode in which notes cannot
+// be modified and returns the new state as JSON. Enabling returns
+// after all the writes in progress are finished.
+func (s *server) serveAPIMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, s.tr("Method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	var on bool
+	if v := r.FormValue("on"); v != "" {
+		var err error
+		if on, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, s.tr("Bad request: on parameter must be true or false"), http.StatusBadRequest)
+			return
+		}
+		s.maint.Set(on)
+	} else {
+		on = s.maint.Toggle()
+	}
+	log.Printf("maintenance mode: %v", on)
+	data := struct {
+		Maintenance bool `json:"maintenance"`
+	}{on}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -8,10 +8,13 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
@@ -24,6 +27,16 @@ import (
 
 const timeLayout = "2006-01-02 15:04:05 -0700"
 
+// location is the time zone in which dates are presented (in
+// listings, exports and git commits), see option -tz.
+var location = time.Local
+
+// unixTime returns the time corresponding to the given Unix time in
+// the presentation time zone.
+func unixTime(sec int64) time.Time {
+	return time.Unix(sec, 0).In(location)
+}
+
 type Notes struct {
 	URL           string
 	Notes         []*Note
@@ -31,29 +44,41 @@ type Notes struct {
 	AllTags       []string
 	ActiveTags    []string
 	AvailableTags []string
+	RelatedTags   []string // tags frequently occurring with active tags
+	Subtopics     []string // descendants of the active topic
 	isHTML        bool
 	Messages      []string
 	Count         int
 	Start         int
 	More          bool
+	Trash         bool   // notes are in the trash (may be restored)
+	PrintMode     bool   // render notes only (without navigation and forms)
+	Compact       bool   // show only the first line of each note
+	Title         string // instance name (see -title)
 }
 
 type Note struct {
-	Topics   []string
-	Tags     []string
-	Created  time.Time
-	Modified time.Time
-	ID       int64
-	Text     string
-	NoFooter bool
+	Topics     []string
+	Tags       []string
+	Created    time.Time
+	Modified   time.Time
+	ID         int64
+	Text       string
+	NoFooter   bool
+	CopiedFrom int64 // ID of the note this one is a copy of (if positive)
+	EditCount  int   // number of edits (based on git history)
 }
 
 // IDs return slice of IDs of notes to be displayed on a web page used
 // for selecting next/previous note using keys on the web page.
+// Synthetic notes (such as "No such notes" or the index of topics and
+// tags) have no ID (i.e., zero ID) and are skipped.
 func (n *Notes) IDs() []int64 {
-	ids := make([]int64, len(n.Notes))
-	for i, note := range n.Notes {
-		ids[i] = note.ID
+	ids := make([]int64, 0, len(n.Notes))
+	for _, note := range n.Notes {
+		if note.ID > 0 {
+			ids = append(ids, note.ID)
+		}
 	}
 	return ids
 }
@@ -62,7 +87,7 @@ func (n *Notes) TagURL(tag string) string {
 	s := n.URL
 	q := ""
 	if i := strings.IndexByte(s, '?'); i >= 0 {
-		q = qParam(s[i:])
+		q = keptParams(s[i:])
 		s = s[:i]
 	}
 	if s == "/" {
@@ -70,9 +95,10 @@ func (n *Notes) TagURL(tag string) string {
 	}
 	tags := strings.Split(s[1:], "/")
 	if strings.HasPrefix(tag, "/") {
-		tags[0] = tag
+		tags[0] = topicPath(tag)
 		return strings.Join(tags, "/") + q
 	} else {
+		tag = url.PathEscape(tag)
 		for _, t := range tags[1:] {
 			if tag == t {
 				return s + q
@@ -82,6 +108,35 @@ func (n *Notes) TagURL(tag string) string {
 	}
 }
 
+// topicPath returns the URL path of the listing of notes with a given
+// topic. The slashes of a multi-level topic (such as "/work/project")
+// are escaped so that the topic stays in the first path segment.
+func topicPath(topic string) string {
+	return "/" + url.PathEscape(topic[1:])
+}
+
+// splitPath splits an escaped URL path of a notes listing into
+// unescaped segments.
+func splitPath(path string) ([]string, error) {
+	tags := strings.Split(path, "/")
+	for i, tag := range tags {
+		var err error
+		if tags[i], err = url.PathUnescape(tag); err != nil {
+			return nil, err
+		}
+	}
+	return tags, nil
+}
+
+// pathUnescape returns unescaped path segment s or s itself if it is
+// not properly escaped.
+func pathUnescape(s string) string {
+	if u, err := url.PathUnescape(s); err == nil {
+		return u
+	}
+	return s
+}
+
 // FTSQuery returns the unescaped value of FTS query parameter (named
 // `q`) from a query string or empty string if not found or unescaping
 // failed. Used in layout HTML template to initialize hidden form
@@ -118,15 +173,15 @@ func tagsURL(path, expr, ftsQuery string) string {
 	tags[0] = "/" + tags[0]
 	for _, tag := range newTags {
 		if strings.HasPrefix(tag, "-/") {
-			if tags[0] == tag[1:] {
+			if tags[0] == topicPath(tag[1:]) {
 				tags[0] = "/"
 			}
 		} else if tag[0] == '/' {
-			tags[0] = tag
+			tags[0] = topicPath(tag)
 		} else if tag[0] == '-' {
-			tags = delTag(tags, tag[1:])
+			tags = delTag(tags, url.PathEscape(tag[1:]))
 		} else {
-			tags = addTag(tags, tag)
+			tags = addTag(tags, url.PathEscape(tag))
 		}
 	}
 	if tags[0] == "/" && len(tags) > 1 {
@@ -141,6 +196,29 @@ func tagsURL(path, expr, ftsQuery string) string {
 	return path
 }
 
+// topicFromPath returns the topic of a notes listing path (such as
+// "/a" for "/a/b?q=c") or empty string if the path has no topic.
+func topicFromPath(path string) string {
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	if !strings.HasPrefix(path, "/") {
+		return ""
+	}
+	topic := "/" + pathUnescape(strings.SplitN(path[1:], "/", 2)[0])
+	if topic == "/" || topic == "/-" {
+		return ""
+	}
+	return topic
+}
+
+// titleScope is the prefix of search terms (such as title:foo)
+// matching only note titles (see noteTitle).
+const titleScope = "title:"
+
+// parseSearchExpr splits the search expression into tags (and topics)
+// and full text search query. Words with titleScope prefix are part
+// of the query.
 func parseSearchExpr(expr string) ([]string, string) {
 	const (
 		between = iota
@@ -153,6 +231,14 @@ func parseSearchExpr(expr string) ([]string, string) {
 		state        = between
 		start        = 0
 	)
+	// addWord adds a tag or a search term restricted to note titles
+	addWord := func(word string) {
+		if strings.HasPrefix(word, titleScope) && len(word) > len(titleScope) {
+			search = append(search, word)
+		} else {
+			tags = append(tags, word)
+		}
+	}
 	for i, r := range expr {
 		switch state {
 		case between:
@@ -170,15 +256,15 @@ func parseSearchExpr(expr string) ([]string, string) {
 		case inWord:
 			switch {
 			case r == '\'':
-				tags = append(tags, expr[start:i])
+				addWord(expr[start:i])
 				start = i + 1
 				state = inSingleString
 			case r == '"':
-				tags = append(tags, expr[start:i])
+				addWord(expr[start:i])
 				start = i + 1
 				state = inDoubleString
 			case unicode.IsSpace(r):
-				tags = append(tags, expr[start:i])
+				addWord(expr[start:i])
 				state = between
 			}
 		case inSingleString:
@@ -204,7 +290,7 @@ func parseSearchExpr(expr string) ([]string, string) {
 	switch state {
 	case inWord:
 		if i > start {
-			tags = append(tags, expr[start:i])
+			addWord(expr[start:i])
 		}
 	case inSingleString:
 		if i > start {
@@ -277,18 +363,18 @@ func (n *Notes) ActiveTagsURLs() []tagURL {
 	if tags[0] != "" && tags[0] != "-" {
 		if len(tags) > 1 {
 			i := strings.Index(s, "/")
-			tagsURLs = append(tagsURLs, tagURL{"/" + tags[0], "/-" + s[i:] + q})
+			tagsURLs = append(tagsURLs, tagURL{"/" + pathUnescape(tags[0]), "/-" + s[i:] + q})
 		} else {
-			tagsURLs = append(tagsURLs, tagURL{"/" + tags[0], "/" + q})
+			tagsURLs = append(tagsURLs, tagURL{"/" + pathUnescape(tags[0]), "/" + q})
 		}
 	}
 
 	// Tags
 	if len(tags) == 2 && tags[0] == "-" {
-		tagsURLs = append(tagsURLs, tagURL{tags[1], "/" + q})
+		tagsURLs = append(tagsURLs, tagURL{pathUnescape(tags[1]), "/" + q})
 	} else {
 		for i, tag := range tags[1:] {
-			tagsURLs = append(tagsURLs, tagURL{tag, "/" + strings.Join(append(tags[:i+1:i+1], tags[i+2:]...), "/") + q})
+			tagsURLs = append(tagsURLs, tagURL{pathUnescape(tag), "/" + strings.Join(append(tags[:i+1:i+1], tags[i+2:]...), "/") + q})
 		}
 	}
 
@@ -307,6 +393,19 @@ func (n *Notes) ActiveTagsURLs() []tagURL {
 	return tagsURLs
 }
 
+// TagLinks returns topics and tags of the note with URLs of listings
+// of all notes with given topic or tag.
+func (n *Note) TagLinks() []tagURL {
+	links := make([]tagURL, 0, len(n.Topics)+len(n.Tags))
+	for _, topic := range n.Topics {
+		links = append(links, tagURL{topic, topicPath(topic)})
+	}
+	for _, tag := range n.Tags {
+		links = append(links, tagURL{tag, "/-/" + url.PathEscape(tag)})
+	}
+	return links
+}
+
 func qParam(q string) string {
 	if q == "" {
 		return ""
@@ -319,6 +418,27 @@ func qParam(q string) string {
 	return ""
 }
 
+// keptParams returns those parameters of a query string (starting
+// with "?") which are kept when moving between note listings, i.e.,
+// FTS query (q), tag matching mode (match), excluded tags (exclude),
+// order of notes (sort), compact view (view) and listing of recently
+// created notes (when).
+func keptParams(q string) string {
+	if q == "" {
+		return ""
+	}
+	var params []string
+	for _, p := range strings.Split(q[1:], "&") {
+		if strings.HasPrefix(p, "q=") || p == "match=any" || strings.HasPrefix(p, "exclude=") || p == "sort=viewed" || p == "sort=relevance" || p == "view=compact" || p == "when=today" || p == "when=week" {
+			params = append(params, p)
+		}
+	}
+	if len(params) == 0 {
+		return ""
+	}
+	return "?" + strings.Join(params, "&")
+}
+
 func (n *Notes) PrevPage() string {
 	return n.incStart(-queryLimit)
 }
@@ -327,11 +447,105 @@ func (n *Notes) NextPage() string {
 	return n.incStart(queryLimit)
 }
 
+// ViewedOrder reports whether the notes are ordered with the least
+// recently viewed first (instead of the oldest first).
+func (n *Notes) ViewedOrder() bool {
+	return n.hasParam("sort=viewed")
+}
+
+// RelevanceOrder reports whether full text search results are ordered
+// with the best matches first (instead of the oldest first).
+func (n *Notes) RelevanceOrder() bool {
+	return n.hasParam("sort=relevance")
+}
+
+// Search reports whether the listing shows full text search results
+// (not restricted to a topic or tags).
+func (n *Notes) Search() bool {
+	s := n.URL
+	if i := strings.IndexByte(s, '?'); i >= 0 {
+		s = s[:i]
+	}
+	return (s == "/" || s == "/-" || s == "/-/") && !n.isHTML && n.FTSQuery() != ""
+}
+
+// hasParam reports whether the query string of the listing URL
+// contains the given parameter (such as "sort=viewed").
+func (n *Notes) hasParam(param string) bool {
+	if i := strings.IndexByte(n.URL, '?'); i >= 0 {
+		for _, p := range strings.Split(n.URL[i+1:], "&") {
+			if p == param {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// OrderURL returns URL of the listing with the other order of notes
+// (see ViewedOrder and, for full text search results, RelevanceOrder)
+// or empty string if the listing is neither a listing of notes with
+// given topic or tags nor full text search results.
+func (n *Notes) OrderURL() string {
+	s := n.URL
+	q := ""
+	if i := strings.IndexByte(s, '?'); i >= 0 {
+		q = keptParams(s[i:])
+		s = s[:i]
+	}
+	order, other := "sort=viewed", n.ViewedOrder()
+	if n.Search() {
+		order, other = "sort=relevance", n.RelevanceOrder()
+	} else if s == "/" || s == "/-" || s == "/-/" || n.isHTML || n.Trash {
+		return ""
+	}
+	var params []string
+	if q != "" {
+		for _, p := range strings.Split(q[1:], "&") {
+			if p != order {
+				params = append(params, p)
+			}
+		}
+	}
+	if !other {
+		params = append(params, order)
+	}
+	if len(params) == 0 {
+		return s
+	}
+	return s + "?" + strings.Join(params, "&")
+}
+
+// ViewURL returns URL of the listing switched between the compact and
+// the full view of notes or empty string if not a listing of notes.
+func (n *Notes) ViewURL() string {
+	if n.isHTML {
+		return ""
+	}
+	s := n.URL
+	var params []string
+	if i := strings.IndexByte(s, '?'); i >= 0 {
+		for _, p := range strings.Split(s[i+1:], "&") {
+			if p != "view=compact" {
+				params = append(params, p)
+			}
+		}
+		s = s[:i]
+	}
+	if !n.Compact {
+		params = append(params, "view=compact")
+	}
+	if len(params) == 0 {
+		return s
+	}
+	return s + "?" + strings.Join(params, "&")
+}
+
 func (n *Notes) incStart(inc int) string {
 	s := n.URL
 	q := ""
 	if i := strings.IndexByte(s, '?'); i >= 0 {
-		q = qParam(s[i:])
+		q = keptParams(s[i:])
 		s = s[:i]
 	}
 	var v string
@@ -351,13 +565,26 @@ func (n *Notes) Render(note *Note) (template.HTML, error) {
 		return template.HTML(note.Text), nil
 	}
 	var b bytes.Buffer
-	err := n.md.Render(&b, []byte(note.Text))
+	err := n.md.Render(&b, []byte(expandStatic(note.Text)))
 	if err != nil {
 		return "", err
 	}
 	return template.HTML(b.String()), nil
 }
 
+// staticPlaceholder in the text of a note is replaced with the base
+// URL of static assets (see -static_url) before rendering.
+const staticPlaceholder = "{{static}}"
+
+// expandStatic replaces staticPlaceholder in text with the base URL of
+// static assets (without the trailing slash).
+func expandStatic(text string) string {
+	if !strings.Contains(text, staticPlaceholder) {
+		return text
+	}
+	return strings.Replace(text, staticPlaceholder, strings.TrimSuffix(*staticURL, "/"), -1)
+}
+
 func tagsFromNotes(notes []*Note) []string {
 	m := make(map[string]struct{})
 	for _, n := range notes {
@@ -376,20 +603,229 @@ func tagsFromNotes(notes []*Note) []string {
 	return tags
 }
 
+// CreatedStr returns creation date of the note formatted for
+// listings or empty string for notes without footer.
+func (n *Note) CreatedStr() string {
+	if n.NoFooter {
+		return ""
+	}
+	return n.Created.Format(*dateLayout)
+}
+
+// ModifiedStr returns modification date of the note formatted for
+// listings or empty string for notes without footer.
+func (n *Note) ModifiedStr() string {
+	if n.NoFooter {
+		return ""
+	}
+	return n.Modified.Format(*dateLayout)
+}
+
+var relativeUnits = []struct {
+	d      time.Duration
+	format string
+}{
+	{365 * 24 * time.Hour, "%d years ago"},
+	{30 * 24 * time.Hour, "%d months ago"},
+	{24 * time.Hour, "%d days ago"},
+	{time.Hour, "%d hours ago"},
+	{time.Minute, "%d minutes ago"},
+}
+
+// relativeTime returns d (the time elapsed since some moment) in the
+// largest whole units.
+func relativeTime(d time.Duration, tr translation) string {
+	for _, u := range relativeUnits {
+		if d >= u.d {
+			n := int(d / u.d)
+			f := tr.translate(pluralForm(n) + "|" + u.format)
+			if !strings.Contains(f, "%d") {
+				return f // singular forms may omit the number
+			}
+			return fmt.Sprintf(f, n)
+		}
+	}
+	return tr.translate("just now")
+}
+
+// relativeFormats are the translations used by relativeTime passed to
+// the script of the page which keeps relative times up to date (also
+// of pages served from the browser cache).
+type relativeFormats struct {
+	JustNow string
+	Units   []relativeUnitFormats
+}
+
+type relativeUnitFormats struct {
+	Seconds        int64
+	One, Few, Many string
+}
+
+func newRelativeFormats(tr translation) *relativeFormats {
+	f := &relativeFormats{JustNow: tr.translate("just now")}
+	for _, u := range relativeUnits {
+		f.Units = append(f.Units, relativeUnitFormats{int64(u.d / time.Second),
+			tr.translate("one|" + u.format), tr.translate("few|" + u.format), tr.translate("many|" + u.format)})
+	}
+	return f
+}
+
+// pluralForm returns the plural form (one, few or many) of n used to
+// choose the translation (few and many differ in Polish).
+func pluralForm(n int) string {
+	switch {
+	case n == 1:
+		return "one"
+	case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+		return "few"
+	default:
+		return "many"
+	}
+}
+
+const maxSlugLen = 50
+
+// noteTitle returns the first markdown heading of the text (or its
+// first non-empty line if there are no headings).
+func noteTitle(text string) string {
+	var title string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			return strings.TrimSpace(strings.TrimLeft(line, "#"))
+		} else if title == "" {
+			title = line
+		}
+	}
+	return title
+}
+
+// Slug returns a short name of the note derived from its title (see
+// noteTitle) for use in file names and URLs.
+func (n *Note) Slug() string {
+	var b []rune
+	hyphen := false
+	for _, r := range strings.ToLower(noteTitle(n.Text)) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if hyphen && len(b) > 0 {
+				b = append(b, '-')
+			}
+			b = append(b, r)
+			hyphen = false
+		} else {
+			hyphen = true
+		}
+		if len(b) >= maxSlugLen {
+			break
+		}
+	}
+	return string(b)
+}
+
+// FirstLine returns the first non-empty line of the note text (without
+// markdown heading markers) shown in the compact view.
+func (n *Note) FirstLine() string {
+	for _, line := range strings.Split(n.Text, "\n") {
+		line = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "#"))
+		if line != "" {
+			return line
+		}
+	}
+	return ""
+}
+
+// Permalink returns the URL of the page of the note (with the slug
+// which is ignored when resolving the URL).
+func (n *Note) Permalink() string {
+	if slug := n.Slug(); slug != "" {
+		return fmt.Sprintf("/_/note/%d-%s", n.ID, slug)
+	}
+	return fmt.Sprintf("/_/note/%d", n.ID)
+}
+
+// ShortLink returns the stable URL of the note (it depends only on
+// the note ID, not on its text or tags) which redirects to Permalink.
+func (n *Note) ShortLink() string {
+	return shortLink(n.ID)
+}
+
+// shortLink returns the stable URL of the note with given ID (see
+// Note.ShortLink).
+func shortLink(id int64) string {
+	return fmt.Sprintf("/_/n/%d", id)
+}
+
+// canonicalOrder sorts topics (by level, see topicsByLevel) before
+// tags (sorted alphabetically). This order is used whenever a note is
+// serialized (exported, written to git or hashed).
+type canonicalOrder []string
+
+func (t canonicalOrder) Len() int      { return len(t) }
+func (t canonicalOrder) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+
+func (t canonicalOrder) Less(i, j int) bool {
+	topicI, topicJ := strings.HasPrefix(t[i], "/"), strings.HasPrefix(t[j], "/")
+	switch {
+	case topicI != topicJ:
+		return topicI
+	case topicI:
+		return topicsByLevel(t).Less(i, j)
+	default:
+		return t[i] < t[j]
+	}
+}
+
+// concatTags returns topics followed by tags. Unlike append(topics,
+// tags...) it never writes to the backing array of topics, which may
+// be shared (e.g., with tags or with the cached list of all topics).
+func concatTags(topics, tags []string) []string {
+	k := len(topics)
+	return append(topics[:k:k], tags...)
+}
+
+// canonicalTags returns a sorted copy of given topics and tags (see
+// canonicalOrder).
+func canonicalTags(tags []string) []string {
+	sorted := append([]string{}, tags...)
+	sort.Sort(canonicalOrder(sorted))
+	return sorted
+}
+
 func (n *Note) sha1sum() string {
-	k := len(n.Topics)
-	tags := strings.Join(append(n.Topics[:k:k], n.Tags...), " ")
+	tags := strings.Join(canonicalTags(concatTags(n.Topics, n.Tags)), " ")
 	h := sha1.Sum([]byte(tags + "\x00" + n.Text))
 	return hex.EncodeToString(h[:])
 }
 
 func (n *Note) WriteTo(w io.Writer) (int64, error) {
-	tags := strings.Join(append(n.Topics, n.Tags...), " ")
-	m, err := fmt.Fprintf(w, "%s\n%s\n%s\n%d\n\n%s\n",
-		tags, n.Created.Format(timeLayout), n.Modified.Format(timeLayout), n.ID, n.Text)
+	return n.writeTo(w, true)
+}
+
+// writeTo writes the note in the export format, the line with the note
+// ID is omitted unless withID is true.
+func (n *Note) writeTo(w io.Writer, withID bool) (int64, error) {
+	tags := strings.Join(canonicalTags(concatTags(n.Topics, n.Tags)), " ")
+	id := ""
+	if withID {
+		id = strconv.FormatInt(n.ID, 10) + "\n"
+	}
+	m, err := fmt.Fprintf(w, "%s\n%s\n%s\n%s\n%s\n",
+		tags, n.Created.Format(timeLayout), n.Modified.Format(timeLayout), id, n.Text)
 	return int64(m), err
 }
 
+// checkSeparator returns an error if the given string is not a valid
+// notes separator line.
+func checkSeparator(sep string) error {
+	if !strings.HasPrefix(sep, "***") {
+		return ErrThreeStars
+	}
+	if strings.ContainsAny(sep, "\r\n") {
+		return errors.New("separator must be a single line")
+	}
+	return nil
+}
+
 // notesSep returns the shortest slice matching the regular expression
 // "[*][*][*]+\s*\n" which does not occur on any of the notes (at the
 // begining of a line).
@@ -438,12 +874,73 @@ func notesSep(notes []*Note) []byte {
 	}
 }
 
-func export(w io.Writer, notes []*Note) error {
-	sep := notesSep(notes)
+// export writes the notes separated with the given separator line
+// (without the trailing newline) or, if it is empty, with the shortest
+// separator not occurring in the notes. Note IDs are omitted unless
+// withIDs is true (so that exports of different databases may be
+// compared). If there are no notes nothing is written and ErrNoNotes
+// is returned.
+func export(w io.Writer, notes []*Note, separator string, withIDs bool) error {
+	if len(notes) == 0 {
+		return ErrNoNotes
+	}
+	var sep []byte
+	if separator == "" {
+		sep = notesSep(notes)
+	} else {
+		if err := checkSeparator(separator); err != nil {
+			return err
+		}
+		for _, n := range notes {
+			for _, line := range strings.Split(n.Text, "\n") {
+				if line == separator {
+					return fmt.Errorf("note %d contains separator line %q", n.ID, separator)
+				}
+			}
+		}
+		sep = []byte(separator + "\n")
+	}
 	for _, n := range notes {
 		_, err := w.Write(sep)
 		if err == nil {
-			_, err = n.WriteTo(w)
+			_, err = n.writeTo(w, withIDs)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMarkdownFile writes the note as markdown with a front matter
+// carrying its topics, tags, dates (see parseFrontMatter) and its
+// stable link (see Note.ShortLink, ignored on import).
+func (n *Note) writeMarkdownFile(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "---\ntopics: [%s]\ntags: [%s]\ncreated: %s\nmodified: %s\nlink: %s\n---\n%s\n",
+		strings.Join(n.Topics, ", "), strings.Join(n.Tags, ", "),
+		n.Created.Format(timeLayout), n.Modified.Format(timeLayout), n.ShortLink(), n.Text)
+	return err
+}
+
+// exportToDir writes each of the notes to a separate markdown file
+// <id>-<slug>.md in the given directory (created if it does not
+// exist).
+func exportToDir(dir string, notes []*Note) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, n := range notes {
+		name := fmt.Sprintf("%d.md", n.ID)
+		if slug := n.Slug(); slug != "" {
+			name = fmt.Sprintf("%d-%s.md", n.ID, slug)
+		}
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		err = n.writeMarkdownFile(f)
+		if e := f.Close(); err == nil {
+			err = e
 		}
 		if err != nil {
 			return err
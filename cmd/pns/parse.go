@@ -7,8 +7,11 @@ package main
 import (
 	"bufio"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -16,21 +19,24 @@ import (
 
 var (
 	ErrThreeStars        = errors.New(`separator (first line of imported file) should start with "***"`)
+	ErrSeparator         = errors.New("separator (first line of imported file) differs from the expected one")
 	ErrEmptyTagList      = errors.New("empty tag list")
 	ErrNoTopic           = errors.New("no topic in a tag list")
 	ErrEmptyLineExpected = errors.New("empty line expected after the header")
 )
 
-func parseFile(filename string) ([]*Note, error) {
+func parseFile(filename, expectedSep string) ([]*Note, error) {
 	f, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	return parse(f)
+	return parse(f, expectedSep)
 }
 
-func parse(r io.Reader) ([]*Note, error) {
+// parse parses notes in the export format. If expectedSep is not
+// empty the separator (first line) must be equal to it.
+func parse(r io.Reader, expectedSep string) ([]*Note, error) {
 	var sep string
 	var err error
 	var notes []*Note
@@ -40,6 +46,9 @@ func parse(r io.Reader) ([]*Note, error) {
 		if !strings.HasPrefix(sep, "***") {
 			return nil, ErrThreeStars
 		}
+		if expectedSep != "" && sep != expectedSep {
+			return nil, ErrSeparator
+		}
 	} else {
 		if err = sc.Err(); err != nil {
 			return nil, err
@@ -73,18 +82,21 @@ outer:
 		} else {
 			break
 		}
-		if sc.Scan() {
+		// the line with the note ID is optional
+		if !sc.Scan() {
+			break
+		}
+		if sc.Text() != "" {
 			n.ID, err = strconv.ParseInt(sc.Text(), 10, 64)
 			if err != nil {
 				return nil, err
 			}
-		}
-		if sc.Scan() {
+			if !sc.Scan() {
+				break
+			}
 			if sc.Text() != "" {
 				return nil, ErrEmptyLineExpected
 			}
-		} else {
-			break
 		}
 		var lines []string
 		for sc.Scan() {
@@ -128,3 +140,172 @@ func (n *Note) parseTags(line string) error {
 	}
 	return nil
 }
+
+// parseFrontMatter returns topics and tags declared in the front
+// matter of the text (a block delimited with "---" lines at the
+// beginning of the text) and the text following the front matter. The
+// values of "topics" and "tags" keys may be given as [a, b] lists,
+// space separated words or "- a" items on the following lines.
+func parseFrontMatter(text string) (topics, tags []string, rest string, ok bool) {
+	lines, rest, ok := frontMatterLines(text)
+	if !ok {
+		return nil, nil, text, false
+	}
+	var key string
+	for _, line := range lines {
+		var values string
+		if trimmed := strings.TrimSpace(line); strings.HasPrefix(trimmed, "- ") {
+			values = trimmed[2:]
+		} else if i := strings.IndexByte(line, ':'); i >= 0 {
+			key = strings.TrimSpace(line[:i])
+			values = strings.Trim(strings.TrimSpace(line[i+1:]), "[]")
+		} else {
+			continue
+		}
+		for _, v := range strings.Fields(strings.Replace(values, ",", " ", -1)) {
+			v = strings.Trim(v, `"'`)
+			switch {
+			case v == "":
+			case key == "topics" && !strings.HasPrefix(v, "/"):
+				topics = addTag(topics, "/"+v)
+			case key == "topics" || key == "tags" && strings.HasPrefix(v, "/"):
+				topics = addTag(topics, v)
+			case key == "tags":
+				tags = addTag(tags, v)
+			}
+		}
+	}
+	return topics, tags, rest, true
+}
+
+// frontMatterLines returns the lines of the front matter of the text
+// (without the "---" delimiters) and the text following it.
+func frontMatterLines(text string) (lines []string, rest string, ok bool) {
+	lines = strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n")
+	if lines[0] != "---" {
+		return nil, text, false
+	}
+	for i, line := range lines[1:] {
+		if line == "---" {
+			return lines[1 : i+1], strings.Join(lines[i+2:], "\n"), true
+		}
+	}
+	return nil, text, false
+}
+
+// frontMatterDates returns the dates declared with "created" and
+// "modified" keys in the front matter of the text (as written by
+// Note.writeMarkdownFile or in RFC 3339 format), zero times for
+// missing or invalid ones.
+func frontMatterDates(text string) (created, modified time.Time) {
+	lines, _, _ := frontMatterLines(text)
+	for _, line := range lines {
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		value := strings.Trim(strings.TrimSpace(line[i+1:]), `"'`)
+		t, err := time.Parse(timeLayout, value)
+		if err != nil {
+			if t, err = time.Parse(time.RFC3339, value); err != nil {
+				continue
+			}
+		}
+		switch strings.TrimSpace(line[:i]) {
+		case "created":
+			created = t
+		case "modified":
+			modified = t
+		}
+	}
+	return created, modified
+}
+
+// mergeFrontMatter returns the text (without the front matter unless
+// keep is true) and given topics and tags merged with those declared
+// in the front matter of the text.
+func mergeFrontMatter(text string, topics, tags []string, keep bool) (string, []string, []string) {
+	fmTopics, fmTags, rest, ok := parseFrontMatter(text)
+	if !ok {
+		return text, topics, tags
+	}
+	for _, t := range fmTopics {
+		topics = addTag(topics, t)
+	}
+	for _, t := range fmTags {
+		tags = addTag(tags, t)
+	}
+	if keep {
+		return text, topics, tags
+	}
+	return rest, topics, tags
+}
+
+// parseDir parses markdown (.md) files in the directory tree as notes
+// (one note per file, without the final newline). Topics, tags and
+// dates are taken from the front matter of a file (which is removed
+// from the note text unless keepFrontMatter is true), the modification
+// time of the file is used for missing dates. If the front matter
+// declares no topic, the topic is derived from the path of the
+// directory of the file (such as "/work/project" for file
+// work/project/notes.md) or is the name of the given directory for the
+// files at its top level. Errors of individual files are returned as
+// MultiError together with the notes parsed from the remaining files.
+func parseDir(dir string, keepFrontMatter bool) ([]*Note, error) {
+	var (
+		notes []*Note
+		errs  MultiError
+	)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			errs = append(errs, err)
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || strings.ToLower(filepath.Ext(path)) != ".md" {
+			return nil
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		n := &Note{Created: info.ModTime(), Modified: info.ModTime()}
+		text := strings.TrimSuffix(string(b), "\n")
+		created, modified := frontMatterDates(text)
+		if !created.IsZero() {
+			n.Created = created
+		}
+		if !modified.IsZero() {
+			n.Modified = modified
+		}
+		n.Text, n.Topics, n.Tags = mergeFrontMatter(text, nil, nil, keepFrontMatter)
+		if len(n.Topics) == 0 {
+			rel, err := filepath.Rel(dir, filepath.Dir(path))
+			if err != nil {
+				errs = append(errs, err)
+				return nil
+			}
+			if rel == "." {
+				rel = filepath.Base(dir)
+			}
+			topic := "/" + filepath.ToSlash(rel)
+			if strings.ContainsAny(topic, " \t") || topic == "/" || topic == "/." || topic == "/-" {
+				errs = append(errs, fmt.Errorf("%s: no topic in front matter and no valid topic derived from its path", path))
+				return nil
+			}
+			n.Topics = []string{topic}
+		}
+		notes = append(notes, n)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return notes, errs
+	}
+	return notes, nil
+}
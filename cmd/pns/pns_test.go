@@ -6,9 +6,22 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestNotesTagURL(t *testing.T) {
@@ -30,6 +43,10 @@ func TestNotesTagURL(t *testing.T) {
 		{"/-/b", "b", "/-/b"},
 		{"/a/b/c", "b", "/a/b/c"},
 		{"/a/b/c", "c", "/a/b/c"},
+
+		{"/a/b", "/c/d", "/c%2Fd/b"},
+		{"/c%2Fd/b", "/a", "/a/b"},
+		{"/c%2Fd/b", "e", "/c%2Fd/b/e"},
 	}
 	const q = "?q=z"
 	const q2 = "?q=z&start=100"
@@ -91,6 +108,11 @@ func TestTagsURL(t *testing.T) {
 		{"/a/b", "+'c'", "/a/b?q=c"},
 		{"/a/b", "+ 'c' d", "/a/b/d?q=c"},
 		{"/a/b", "+ c 'd e' f", "/a/b/c/f?q=d+e"},
+
+		{"/a/b", "+/c/d", "/c%2Fd/b"},
+		{"/c%2Fd/b", "+e", "/c%2Fd/b/e"},
+		{"/c%2Fd/b", "-/c/d", "/-/b"},
+		{"/c%2Fd/b", "-/c", "/c%2Fd/b"},
 	}
 	for _, test := range tests {
 		if s := tagsURL(test.path, test.expr, ""); s != test.expected {
@@ -144,6 +166,8 @@ func TestParseSearchExpr(t *testing.T) {
 		{`a "" b "" c`, `a.b.c#`},
 		{`a "" b '' c`, `a.b.c#`},
 		{`a "" b "  "`, `a.b#`},
+		{`a title:b c`, `a.c#title:b`},
+		{`title:b 'c' title:`, `title:#title:b c`},
 	}
 	for _, test := range tests {
 		tokens, fts := parseSearchExpr(test.expr)
@@ -184,6 +208,12 @@ func TestNotesActiveTagsURLs(t *testing.T) {
 				{"b", "/"},
 			},
 		},
+		{
+			"/a%2Fb/c", []tagURL{
+				{"/a/b", "/-/c"},
+				{"c", "/a%2Fb"},
+			},
+		},
 		{
 			"/-/b/c", []tagURL{
 				{"b", "/-/c"},
@@ -251,6 +281,23 @@ func TestNotesActiveTagsURLs(t *testing.T) {
 	}
 }
 
+func TestWithout(t *testing.T) {
+	tests := []struct {
+		tags, removed, expected []string
+	}{
+		{[]string{"a", "b", "c"}, []string{"b"}, []string{"a", "c"}},
+		{[]string{"unknowntag"}, []string{"unknowntag"}, nil},
+		{[]string{"a", "unknowntag"}, []string{"unknowntag", "x"}, []string{"a"}},
+		{[]string{"a", "b"}, nil, []string{"a", "b"}},
+	}
+	for _, test := range tests {
+		got := without(test.tags, test.removed)
+		if strings.Join(got, " ") != strings.Join(test.expected, " ") {
+			t.Errorf("for %q without %q expected %q but got %q", test.tags, test.removed, test.expected, got)
+		}
+	}
+}
+
 func TestNotesIncStart(t *testing.T) {
 	tests := []struct {
 		path       string
@@ -270,6 +317,13 @@ func TestNotesIncStart(t *testing.T) {
 		{"/a?q=%22z%22", 0, -1, "/a?q=%22z%22"},
 		{"/a?q=%22z%22", 30, -100, "/a?q=%22z%22"},
 		{"/a?start=30&q=%22z%22", 30, -100, "/a?q=%22z%22"},
+
+		{"/a?match=any", 0, 100, "/a?match=any&start=100"},
+		{"/a?q=%22z%22&match=any&start=10", 10, 100, "/a?q=%22z%22&match=any&start=110"},
+		{"/a?start=30&match=any", 30, -100, "/a?match=any"},
+		{"/a?exclude=b&start=10", 10, 100, "/a?exclude=b&start=110"},
+		{"/?when=week", 0, 100, "/?when=week&start=100"},
+		{"/?when=today&start=100", 100, -100, "/?when=today"},
 	}
 	for _, test := range tests {
 		paths := []string{test.path}
@@ -287,6 +341,67 @@ func TestNotesIncStart(t *testing.T) {
 	}
 }
 
+func TestNotesOrderURL(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/", ""},
+		{"/-", ""},
+		{"/a", "/a?sort=viewed"},
+		{"/a?sort=viewed", "/a"},
+		{"/a?start=10", "/a?sort=viewed"},
+		{"/a?q=%22z%22&start=10&sort=viewed", "/a?q=%22z%22"},
+		{"/a?match=any&other=value", "/a?match=any&sort=viewed"},
+		{"/?q=x", "/?q=x&sort=relevance"},
+		{"/-?q=x&sort=relevance&start=100", "/-?q=x"},
+		{"/?when=week&start=100", ""},
+	}
+	for _, test := range tests {
+		n := Notes{URL: test.path}
+		if s := n.OrderURL(); s != test.expected {
+			t.Errorf("for %q expected %q but got %q", test.path, test.expected, s)
+		}
+	}
+}
+
+func TestNotesIDs(t *testing.T) {
+	tests := []struct {
+		notes    []*Note
+		expected []int64
+	}{
+		{nil, []int64{}},
+		{[]*Note{{ID: 3}, {ID: 1}}, []int64{3, 1}},
+		{[]*Note{{Text: "# No such notes", NoFooter: true}}, []int64{}},
+		{[]*Note{{Text: "topics", NoFooter: true}, {Text: "tags", NoFooter: true}}, []int64{}},
+		{[]*Note{{ID: 5}, {Text: "synthetic", NoFooter: true}, {ID: 7}}, []int64{5, 7}},
+	}
+	for _, test := range tests {
+		n := Notes{Notes: test.notes}
+		ids := n.IDs()
+		if ids == nil || !reflect.DeepEqual(ids, test.expected) {
+			t.Errorf("expected %v but got %#v", test.expected, ids)
+		}
+	}
+}
+
+func TestExpandStatic(t *testing.T) {
+	defer func(old string) { *staticURL = old }(*staticURL)
+	tests := []struct {
+		base, text, expected string
+	}{
+		{"/_/static", "![img]({{static}}/a.png)", "![img](/_/static/a.png)"},
+		{"https://cdn.example.com/pns/", "{{static}}/a.png {{static}}/b.png", "https://cdn.example.com/pns/a.png https://cdn.example.com/pns/b.png"},
+		{"/assets", "no placeholder {static}", "no placeholder {static}"},
+	}
+	for _, test := range tests {
+		*staticURL = test.base
+		if s := expandStatic(test.text); s != test.expected {
+			t.Errorf("for (%q, %q) expected %q but got %q", test.base, test.text, test.expected, s)
+		}
+	}
+}
+
 func TestNotesSep(t *testing.T) {
 	expected := "******\n"
 	for _, s := range []string{
@@ -327,6 +442,123 @@ func TestAddedRemoved(t *testing.T) {
 	}
 }
 
+func TestRepeatedTags(t *testing.T) {
+	tests := []struct {
+		field, repeated string
+	}{
+		{"", ""},
+		{"/a b c", ""},
+		{"/a b /a", "/a"},
+		{"b /a b b c /a", "b /a"},
+		{"a /a", ""},
+	}
+	for _, test := range tests {
+		if s := strings.Join(repeatedTags(strings.Fields(test.field)), " "); s != test.repeated {
+			t.Errorf("for %q expected %q but got %q", test.field, test.repeated, s)
+		}
+	}
+}
+
+func TestRelativeTime(t *testing.T) {
+	tests := []struct {
+		d      time.Duration
+		en, pl string
+	}{
+		{-time.Minute, "just now", "przed chwilą"},
+		{30 * time.Second, "just now", "przed chwilą"},
+		{time.Minute, "1 minute ago", "minutę temu"},
+		{3 * time.Minute, "3 minutes ago", "3 minuty temu"},
+		{59 * time.Minute, "59 minutes ago", "59 minut temu"},
+		{90 * time.Minute, "1 hour ago", "godzinę temu"},
+		{22 * time.Hour, "22 hours ago", "22 godziny temu"},
+		{12 * time.Hour, "12 hours ago", "12 godzin temu"},
+		{2 * 24 * time.Hour, "2 days ago", "2 dni temu"},
+		{45 * 24 * time.Hour, "1 month ago", "miesiąc temu"},
+		{5 * 30 * 24 * time.Hour, "5 months ago", "5 miesięcy temu"},
+		{3 * 365 * 24 * time.Hour, "3 years ago", "3 lata temu"},
+	}
+	for _, test := range tests {
+		if s := relativeTime(test.d, enTranslation); s != test.en {
+			t.Errorf("for %v expected %q but got %q", test.d, test.en, s)
+		}
+		if s := relativeTime(test.d, plTranslation); s != test.pl {
+			t.Errorf("for %v expected %q but got %q", test.d, test.pl, s)
+		}
+	}
+}
+
+func TestStartParam(t *testing.T) {
+	tests := []struct {
+		query    string
+		max      int
+		expected int
+		err      error
+	}{
+		{"", 1000, 0, nil},
+		{"start=x", 1000, 0, nil},
+		{"start=-100", 1000, 0, nil},
+		{"start=200", 1000, 200, nil},
+		{"start=1000", 1000, 1000, nil},
+		{"start=1100", 1000, 0, errStartTooLarge},
+		{"start=1000000", 0, 1000000, nil},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/a?"+test.query, nil)
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		if start, err := startParam(r, test.max); start != test.expected || err != test.err {
+			t.Errorf("for %q (max %d) expected %d (%v) but got %d (%v)", test.query, test.max, test.expected, test.err, start, err)
+		}
+	}
+}
+
+func TestWhenSince(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	now := time.Date(2024, 3, 2, 0, 30, 0, 0, loc)
+	tests := []struct {
+		when     string
+		expected time.Time
+		ok       bool
+	}{
+		{"today", time.Date(2024, 3, 2, 0, 0, 0, 0, loc), true},
+		{"week", time.Date(2024, 2, 25, 0, 0, 0, 0, loc), true},
+		{"month", time.Time{}, false},
+		{"", time.Time{}, false},
+	}
+	for _, test := range tests {
+		if since, ok := whenSince(test.when, now); !since.Equal(test.expected) || ok != test.ok {
+			t.Errorf("for %q expected %v (%v) but got %v (%v)", test.when, test.expected, test.ok, since, ok)
+		}
+	}
+}
+
+func TestActivityRange(t *testing.T) {
+	now := time.Date(2024, 3, 2, 15, 4, 5, 0, time.UTC)
+	day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		from, to       string
+		expFrom, expTo time.Time
+		ok             bool
+	}{
+		{"", "", day(2023, 3, 4), day(2024, 3, 3), true},
+		{"2024-01-01", "", day(2024, 1, 1), day(2024, 3, 3), true},
+		{"2024-01-01", "2024-01-31", day(2024, 1, 1), day(2024, 2, 1), true},
+		{"", "2024-01-31", day(2023, 2, 1), day(2024, 2, 1), true},
+		{"2024-02-01", "2024-01-31", time.Time{}, time.Time{}, false},
+		{"yesterday", "", time.Time{}, time.Time{}, false},
+		{"", "2024-13-01", time.Time{}, time.Time{}, false},
+	}
+	for _, test := range tests {
+		from, to, err := activityRange(test.from, test.to, now)
+		if (err == nil) != test.ok {
+			t.Errorf("for (%q, %q) expected ok=%v but got %v", test.from, test.to, test.ok, err)
+		} else if test.ok && (!from.Equal(test.expFrom) || !to.Equal(test.expTo)) {
+			t.Errorf("for (%q, %q) expected [%v, %v) but got [%v, %v)", test.from, test.to, test.expFrom, test.expTo, from, to)
+		}
+	}
+}
+
 func TestSplitTokens(t *testing.T) {
 	input := "  aąbc[i++] = test;\nąę"
 	expected := []string{" ", " ", "aąbc", "[", "i", "+", "+", "]", " ", "=", " ", "test", ";", "\n", "ąę"}
@@ -386,7 +618,7 @@ The end.
 
 func TestHtmlDiff(t *testing.T) {
 	var b bytes.Buffer
-	err := htmlDiff(&b, "Test", "Test")
+	err := htmlDiff(&b, "Test", "Test", false)
 	if err != NoDifference {
 		t.Error("expected NoDifference")
 	}
@@ -396,11 +628,29 @@ func TestHtmlDiff(t *testing.T) {
 	}
 	checkHtmlDiff(t, `Test abc`, `Test def`, `<div class="del">Test <del>abc</del></div><div class="ins">Test <ins>def</ins></div>`)
 	checkHtmlDiff(t, testOldText, testNewText, testExpectedDiff)
+	if err := htmlDiff(&b, "a b\nc\n\nd", "a\nb c\n\nd\n", true); err != NoDifference {
+		t.Errorf("expected NoDifference ignoring whitespace but got %v", err)
+	}
+}
+
+func TestNormalizeWhitespace(t *testing.T) {
+	tests := []struct {
+		input, expected string
+	}{
+		{"a  b\nc", "a b c\n"},
+		{"a b\n\n c\td\n", "a b\n\nc d\n"},
+		{"\na\n \n\n\nb\n\n", "a\n\nb\n"},
+	}
+	for _, test := range tests {
+		if got := normalizeWhitespace(test.input); got != test.expected {
+			t.Errorf("for %q expected %q but got %q", test.input, test.expected, got)
+		}
+	}
 }
 
 func checkHtmlDiff(t *testing.T, oldText, newText, expectedDiff string) {
 	var b bytes.Buffer
-	err := htmlDiff(&b, oldText, newText)
+	err := htmlDiff(&b, oldText, newText, false)
 	if err != nil {
 		t.Error("expected no error but got: ", err.Error())
 		return
@@ -430,3 +680,1774 @@ func TestIdToGitName(t *testing.T) {
 		}
 	}
 }
+
+// newTestDB returns an initialized in-memory database (without git)
+// and a function closing it.
+func newTestDB(t testing.TB) (*DB, func()) {
+	db, err := OpenDBMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, func() { db.db.Close() }
+}
+
+func TestNotesPagingEqualCreated(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	created := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	var notes []*Note
+	for i := 0; i < queryLimit+queryLimit/2; i++ {
+		notes = append(notes, &Note{Topics: []string{"/a"}, Created: created, Modified: created, Text: fmt.Sprint(i)})
+	}
+	if err := db.Import(notes, false); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[int64]bool)
+	var last int64
+	for start := 0; start < len(notes); start += queryLimit {
+		page, err := db.Notes("/a", nil, "", start, orderByCreated, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) > queryLimit {
+			page = page[:queryLimit]
+		}
+		for _, n := range page {
+			if seen[n.ID] {
+				t.Errorf("note %d returned twice", n.ID)
+			}
+			if n.ID < last {
+				t.Errorf("note %d returned after note %d", n.ID, last)
+			}
+			seen[n.ID] = true
+			last = n.ID
+		}
+	}
+	if len(seen) != len(notes) {
+		t.Errorf("expected %d notes but got %d", len(notes), len(seen))
+	}
+}
+
+func TestNotesExclude(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	created := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	notes := []*Note{
+		{Topics: []string{"/a"}, Tags: []string{"b"}, Created: created, Modified: created, Text: "x"},
+		{Topics: []string{"/a"}, Created: created, Modified: created, Text: "y"},
+	}
+	if err := db.Import(notes, false); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		exclude  []string
+		expected int
+	}{
+		{nil, 2},
+		{[]string{"b"}, 1},
+		{[]string{"unknowntag"}, 2},
+		{[]string{"unknowntag", "b"}, 1},
+	}
+	for _, test := range tests {
+		found, err := db.Notes("/a", nil, "", 0, orderByCreated, false, test.exclude)
+		if err != nil {
+			t.Errorf("for exclude %v unexpected error %v", test.exclude, err)
+		} else if len(found) != test.expected {
+			t.Errorf("for exclude %v expected %d notes but got %d", test.exclude, test.expected, len(found))
+		}
+	}
+}
+
+type nopExecutor struct{}
+
+func (nopExecutor) ExecuteTemplate(w io.Writer, name string, data interface{}) error {
+	return nil
+}
+
+func TestServeUnknownTag(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	created := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	notes := []*Note{{Topics: []string{"/a"}, Tags: []string{"b"}, Created: created, Modified: created, Text: "x"}}
+	if err := db.Import(notes, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Notes("/a", []string{"c"}, "", 0, orderByCreated, false, nil); !reflect.DeepEqual(err, NoTagsError{"c"}) {
+		t.Errorf("expected NoTagsError but got %v", err)
+	}
+	s := &server{db: db, t: nopExecutor{}, s: NewSessions(), tr: func(s string) string { return s }}
+	tests := []struct {
+		path     string
+		expected int
+	}{
+		{"/a/b", http.StatusOK},
+		{"/a/c", http.StatusNotFound},
+		{"/c", http.StatusNotFound},
+		{"/a/b?exclude=c", http.StatusOK},
+		{"/a?exclude=unknowntag", http.StatusOK},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.expected {
+			t.Errorf("for %q expected status %d but got %d", test.path, test.expected, w.Code)
+		}
+	}
+	db.db.Close()
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/a/c", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected status %d on database error but got %d", http.StatusInternalServerError, w.Code)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	s := &server{t: nopExecutor{}, tr: func(s string) string { return s }}
+	handlers := map[string]http.HandlerFunc{
+		"/_/api/edit/submit/1":  s.serveAPIEditSubmit,
+		"/_/api/add/submit":     s.serveAPIAddSubmit,
+		"/_/api/quickadd":       s.serveAPIQuickAdd,
+		"/_/api/render":         s.serveAPIRender,
+		"/_/delete/1":           s.serveDelete,
+		"/_/restore/1":          s.serveRestore,
+		"/_/login":              s.serveLogin,
+		"/_/api/login":          s.serveAPILogin,
+		"/_/api/sessions/clear": s.serveAPIClearSessions,
+		"/_/sessions/revoke":    s.serveRevokeSession,
+		"/_/api/maintenance":    s.serveAPIMaintenance,
+	}
+	for path, h := range handlers {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("for %s expected status %d but got %d", path, http.StatusMethodNotAllowed, w.Code)
+		}
+		if allow := w.Header().Get("Allow"); allow != "POST" {
+			t.Errorf("for %s expected Allow header %q but got %q", path, "POST", allow)
+		}
+	}
+}
+
+func TestIDFromPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected int64
+		err      error
+	}{
+		{"/_/edit/123", 123, nil},
+		{"/_/edit/123/", 123, nil},
+		{"/_/edit/0", 0, nil},
+		{"/_/edit/", 0, ErrInvalidID},
+		{"/_/edit//", 0, ErrInvalidID},
+		{"/_/edit/123//", 0, ErrInvalidID},
+		{"/_/edit/123/extra", 0, ErrInvalidID},
+		{"/_/edit/123 ", 0, ErrInvalidID},
+		{"/_/edit/ 123", 0, ErrInvalidID},
+		{"/_/edit/+123", 0, ErrInvalidID},
+		{"/_/edit/-123", 0, ErrInvalidID},
+		{"/_/edit/12a", 0, ErrInvalidID},
+		{"/_/edit/99999999999999999999", 0, ErrInvalidID},
+		{"/_/copy/123", 0, ErrPrefixNotFound},
+	}
+	for _, test := range tests {
+		id, err := idFromPath(test.path, "/_/edit/")
+		if id != test.expected || err != test.err {
+			t.Errorf("for %q expected (%d, %v) but got (%d, %v)", test.path, test.expected, test.err, id, err)
+		}
+	}
+}
+
+func TestNotePathInvalidID(t *testing.T) {
+	s := &server{t: nopExecutor{}, tr: func(s string) string { return s }}
+	handlers := map[string]http.HandlerFunc{
+		"/_/n/+5":          s.serveShortLink,
+		"/_/n/5x":          s.serveShortLink,
+		"/_/n/":            s.serveShortLink,
+		"/_/note/+5-title": s.serveNote,
+		"/_/note/-5":       s.serveNote,
+		"/_/note/5x-title": s.serveNote,
+		"/_/note/-title":   s.serveNote,
+	}
+	for path, h := range handlers {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("for %s expected status %d but got %d", path, http.StatusNotFound, w.Code)
+		}
+	}
+}
+
+func TestHostChecker(t *testing.T) {
+	tests := []struct {
+		hosts   string
+		host    string
+		allowed bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "example.com:8080", true},
+		{"example.com", "other.com", false},
+		{"example.com:8080", "example.com:8080", true},
+		{"example.com:8080", "example.com", false},
+		{"example.com:8080", "example.com:8081", false},
+		{"pns.lan,pns.tailnet.ts.net", "pns.lan", true},
+		{"pns.lan,pns.tailnet.ts.net", "pns.tailnet.ts.net:443", true},
+		{"pns.lan, pns.tailnet.ts.net:8080", "pns.tailnet.ts.net:8080", true},
+		{"pns.lan, pns.tailnet.ts.net:8080", "pns.tailnet.ts.net", false},
+		{"pns.lan,pns.tailnet.ts.net", "example.com", false},
+		{".example.com", "pns.example.com", true},
+		{".example.com", "a.b.example.com:8080", true},
+		{".example.com", "example.com", false},
+		{".example.com", "badexample.com", false},
+		{".example.com:8443", "pns.example.com:8443", true},
+		{".example.com:8443", "pns.example.com", false},
+		{"example.com,.example.com", "example.com", true},
+	}
+	for _, test := range tests {
+		hc, err := newHostChecker(test.hosts, nil)
+		if err != nil {
+			t.Errorf("for %q unexpected error: %v", test.hosts, err)
+			continue
+		}
+		if allowed := hc.allowed(test.host); allowed != test.allowed {
+			t.Errorf("for (%q, %q) expected %v but got %v", test.hosts, test.host, test.allowed, allowed)
+		}
+	}
+}
+
+func TestHostCheckerInvalid(t *testing.T) {
+	for _, hosts := range []string{"*.example.com", ".", ".example..com", ".example.com.", ".exa mple.com", ".example.com:port", "a.com,.b_c.com"} {
+		if _, err := newHostChecker(hosts, nil); err == nil {
+			t.Errorf("for %q expected error", hosts)
+		}
+	}
+}
+
+func TestCleanBasePath(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+		valid    bool
+	}{
+		{"", "", true},
+		{"/", "", true},
+		{"/notes", "/notes", true},
+		{"/notes/", "/notes", true},
+		{"/a/notes", "/a/notes", true},
+		{"notes", "", false},
+		{"/a//notes", "", false},
+		{"/a/../notes", "", false},
+		{"/notes?x", "", false},
+	}
+	for _, test := range tests {
+		p, err := cleanBasePath(test.path)
+		if p != test.expected || (err == nil) != test.valid {
+			t.Errorf("for %q expected %q (valid %v) but got %q (%v)", test.path, test.expected, test.valid, p, err)
+		}
+	}
+}
+
+func TestBasePathHandler(t *testing.T) {
+	h := &basePathHandler{"/notes", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	})}
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/notes/", http.StatusOK, "/"},
+		{"/notes/_/static/pns.js", http.StatusOK, "/_/static/pns.js"},
+		{"/notes", http.StatusMovedPermanently, ""},
+		{"/notesx/", http.StatusNotFound, ""},
+		{"/_/add", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.code || (test.code == http.StatusOK && w.Body.String() != test.body) {
+			t.Errorf("for %s expected %d %q but got %d %q", test.path, test.code, test.body, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestSetFlagsFromEnv(t *testing.T) {
+	env := map[string]string{"PNS_DB_FILE": "env.db", "PNS_HTTP": ":8080", "PNS_HOST": "", "PNS_MAX_NOTES": "100", "PNS_INIT": "git"}
+	lookupEnv := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	tests := []struct {
+		args     []string
+		expected map[string]string
+	}{
+		{nil, map[string]string{"f": "env.db", "http": ":8080", "host": "", "max_notes": "100", "init": ""}},
+		{[]string{"-f", "flag.db", "-max_notes=5"}, map[string]string{"f": "flag.db", "http": ":8080", "max_notes": "5"}},
+		{[]string{"-host", "pns.lan"}, map[string]string{"f": "env.db", "host": "pns.lan"}},
+	}
+	for _, test := range tests {
+		fs := flag.NewFlagSet("pns", flag.ContinueOnError)
+		for _, name := range []string{"f", "http", "host", "init"} {
+			fs.String(name, "", "")
+		}
+		fs.Int("max_notes", 0, "")
+		if err := fs.Parse(test.args); err != nil {
+			t.Fatal(err)
+		}
+		if err := setFlagsFromEnv(fs, lookupEnv); err != nil {
+			t.Errorf("for %q unexpected error: %v", test.args, err)
+			continue
+		}
+		for name, value := range test.expected {
+			if v := fs.Lookup(name).Value.String(); v != value {
+				t.Errorf("for %q expected -%s=%q but got %q", test.args, name, value, v)
+			}
+		}
+	}
+
+	fs := flag.NewFlagSet("pns", flag.ContinueOnError)
+	fs.Int("max_notes", 0, "")
+	env["PNS_MAX_NOTES"] = "many"
+	if err := setFlagsFromEnv(fs, lookupEnv); err == nil {
+		t.Error("expected error for invalid PNS_MAX_NOTES")
+	}
+}
+
+func TestSessionsClear(t *testing.T) {
+	s := NewSessions()
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, err := s.NewSession("bob", time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if n := s.Clear(); n != 3 {
+		t.Errorf("expected 3 cleared sessions but got %d", n)
+	}
+	for _, id := range ids {
+		if _, err := s.CheckSession(id); err != ErrAuth {
+			t.Errorf("session %s still valid after Clear", id)
+		}
+	}
+	if _, err := s.NewSession("bob", time.Hour); err != nil {
+		t.Errorf("unexpected error after Clear: %v", err)
+	}
+}
+
+func TestSessionsList(t *testing.T) {
+	s := NewSessions()
+	first, err := s.NewSession("bob", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.NewSession("bob", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.NewSession("alice", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Count(); n != 3 {
+		t.Errorf("expected 3 sessions but got %d", n)
+	}
+	list := s.List("bob", second)
+	if len(list) != 2 {
+		t.Fatalf("expected 2 sessions but got %d", len(list))
+	}
+	for _, info := range list {
+		if info.Handle == first || info.Handle == second {
+			t.Errorf("session ID exposed as handle")
+		}
+		if info.Current != (info.Handle == sessionHandle(second)) {
+			t.Errorf("unexpected Current=%v for %s", info.Current, info.Handle)
+		}
+	}
+	if s.RemoveHandle("bob", sessionHandle(other)) {
+		t.Errorf("session of other user removed")
+	}
+	if !s.RemoveHandle("bob", sessionHandle(first)) {
+		t.Errorf("expected session to be removed")
+	}
+	if s.RemoveHandle("bob", sessionHandle(first)) {
+		t.Errorf("expected session to be already removed")
+	}
+	if _, err := s.CheckSession(first); err != ErrAuth {
+		t.Errorf("revoked session still valid")
+	}
+	if _, err := s.CheckSession(second); err != nil {
+		t.Errorf("other session no longer valid: %v", err)
+	}
+	if list := s.List("alice", ""); len(list) != 1 || list[0].Handle != sessionHandle(other) {
+		t.Errorf("unexpected sessions of other user %v", list)
+	}
+}
+
+func TestSessionDuration(t *testing.T) {
+	s := NewSessions()
+	short, err := s.NewSession("bob", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long, err := s.NewSession("bob", 30*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{short, long} {
+		s.m[v].client = time.Now().Add(-2 * time.Hour)
+	}
+	if d, err := s.CheckSession(short); err != nil || d != time.Hour {
+		t.Errorf("expected (%v, nil) but got (%v, %v)", time.Hour, d, err)
+	}
+	if d, err := s.CheckSession(long); err != nil || d != 0 {
+		t.Errorf("expected no new cookie but got (%v, %v)", d, err)
+	}
+	if e := s.m[long].expires; e.Before(time.Now().Add(29 * 24 * time.Hour)) {
+		t.Errorf("long session not extended by its duration (expires %v)", e)
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	// test vectors of RFC 6238 (SHA1, truncated to 6 digits)
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		sec  int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, test := range tests {
+		if c, err := totpCode(secret, test.sec/totpPeriod); err != nil || c != test.code {
+			t.Errorf("for %d expected %s but got (%s, %v)", test.sec, test.code, c, err)
+		}
+		step := test.sec / totpPeriod
+		if s, ok := checkTOTP(secret, test.code, time.Unix(test.sec+totpPeriod, 0), 0); !ok || s != step {
+			t.Errorf("for %d code from the previous period not accepted (%d, %v)", test.sec, s, ok)
+		}
+		if _, ok := checkTOTP(secret, test.code, time.Unix(test.sec+3*totpPeriod, 0), 0); ok {
+			t.Errorf("for %d expired code accepted", test.sec)
+		}
+		if _, ok := checkTOTP(secret, test.code, time.Unix(test.sec, 0), step); ok {
+			t.Errorf("for %d already used code accepted", test.sec)
+		}
+	}
+	if _, ok := checkTOTP(secret, "", time.Unix(59, 0), 0); ok {
+		t.Errorf("empty code accepted")
+	}
+	s, err := newTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := totpCode(s, 1); err != nil {
+		t.Errorf("generated secret %q is invalid: %v", s, err)
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	tests := []struct {
+		login, password string
+		minLen          int
+		ok              bool
+	}{
+		{"user", "", 8, false},
+		{"user", "", 0, true},
+		{"user", "short1", 8, false},
+		{"user", "abcdefghij", 8, false},
+		{"user", "1234567890", 8, false},
+		{"user", "correct1horse", 8, true},
+		{"user", "zażółć-gęślą", 8, true},
+		{"user", "ąę1", 3, true},
+		{"user1234", "USER1234", 8, false},
+	}
+	for _, test := range tests {
+		err := checkPassword(test.login, test.password, test.minLen)
+		if (err == nil) != test.ok {
+			t.Errorf("for (%q, %q, %d) expected ok=%v but got error %v", test.login, test.password, test.minLen, test.ok, err)
+		}
+		if _, isPasswordError := err.(PasswordError); err != nil && !isPasswordError {
+			t.Errorf("for %q expected PasswordError but got %T", test.password, err)
+		}
+	}
+}
+
+func TestNoteDateStr(t *testing.T) {
+	n := &Note{
+		Created:  time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC),
+		Modified: time.Date(2016, 2, 3, 4, 5, 6, 0, time.UTC),
+	}
+	if s := n.CreatedStr(); s != "2016-01-02" {
+		t.Errorf("expected CreatedStr() = %q but got %q", "2016-01-02", s)
+	}
+	if s := n.ModifiedStr(); s != "2016-02-03" {
+		t.Errorf("expected ModifiedStr() = %q but got %q", "2016-02-03", s)
+	}
+	n.NoFooter = true
+	if s := n.CreatedStr() + n.ModifiedStr(); s != "" {
+		t.Errorf("expected empty dates for note without footer but got %q", s)
+	}
+}
+
+func TestEditRedirectionPath(t *testing.T) {
+	tests := []struct {
+		topics, tags, from, expected string
+	}{
+		{"/a /b", "c", "", "/a/c#7"},
+		{"/a /b", "c", "/b/d?q=x", "/b/c#7"},
+		{"/a /b", "", "/b", "/b#7"},
+		{"/a /b", "c", "/e/c", "/a/c#7"},
+		{"/a /b", "c", "/-/c", "/a/c#7"},
+		{"", "c d", "/a", "/-/c/d#7"},
+		{"", "", "/a", "/"},
+		{"/a/b /c", "d", "/e/d", "/a%2Fb/d#7"},
+		{"/a /a/b", "d", "/a%2Fb/d", "/a%2Fb/d#7"},
+	}
+	for _, test := range tests {
+		got := editRedirectionPath(strings.Fields(test.topics), strings.Fields(test.tags), 7, test.from)
+		if got != test.expected {
+			t.Errorf("for (%q, %q, %q) expected %q but got %q", test.topics, test.tags, test.from, test.expected, got)
+		}
+	}
+}
+
+func TestNoteTagLinks(t *testing.T) {
+	tests := []struct {
+		topics, tags []string
+		expected     []tagURL
+	}{
+		{nil, nil, nil},
+		{
+			[]string{"/a"}, nil, []tagURL{
+				{"/a", "/a"},
+			},
+		},
+		{
+			nil, []string{"b"}, []tagURL{
+				{"b", "/-/b"},
+			},
+		},
+		{
+			[]string{"/a", "/b"}, []string{"c", "d"}, []tagURL{
+				{"/a", "/a"},
+				{"/b", "/b"},
+				{"c", "/-/c"},
+				{"d", "/-/d"},
+			},
+		},
+		{
+			[]string{"/a/b"}, nil, []tagURL{
+				{"/a/b", "/a%2Fb"},
+			},
+		},
+	}
+	for _, test := range tests {
+		n := Note{Topics: test.topics, Tags: test.tags}
+		result := n.TagLinks()
+		if len(result) != len(test.expected) {
+			t.Errorf("for (%q, %q) expected %d items but got %d items", test.topics, test.tags, len(test.expected), len(result))
+			continue
+		}
+		for i, tagURL := range result {
+			if tagURL != test.expected[i] {
+				t.Errorf("for (%q, %q)[%d] expected %q but got %q", test.topics, test.tags, i, test.expected[i], tagURL)
+			}
+		}
+	}
+}
+
+func TestTopicTree(t *testing.T) {
+	topics := []string{"/b", "/a/x/y", "/a-b", "/a", "/a/c"}
+	sort.Sort(topicsByLevel(topics))
+	expected := []topicNode{
+		{"/a", "/a", 0},
+		{"c", "/a%2Fc", 1},
+		{"x", "", 1},
+		{"y", "/a%2Fx%2Fy", 2},
+		{"/a-b", "/a-b", 0},
+		{"/b", "/b", 0},
+	}
+	nodes := topicTree(topics)
+	if !reflect.DeepEqual(nodes, expected) {
+		t.Errorf("expected %v but got %v", expected, nodes)
+	}
+	descendants := descendantTopics(topics, "/a")
+	if !reflect.DeepEqual(descendants, []string{"/a/c", "/a/x/y"}) {
+		t.Errorf("unexpected descendants of /a: %q", descendants)
+	}
+}
+
+func TestCheckDuplicateIDs(t *testing.T) {
+	tests := []struct {
+		ids []int64
+		ok  bool
+	}{
+		{nil, true},
+		{[]int64{1, 2, 3}, true},
+		{[]int64{0, 0, 5}, true},
+		{[]int64{1, 2, 1}, false},
+	}
+	for _, test := range tests {
+		var notes []*Note
+		for _, id := range test.ids {
+			notes = append(notes, &Note{ID: id})
+		}
+		if err := checkDuplicateIDs(notes); (err == nil) != test.ok {
+			t.Errorf("for %v expected ok=%v but got error %v", test.ids, test.ok, err)
+		}
+	}
+}
+
+func TestValidRequestID(t *testing.T) {
+	tests := []struct {
+		id       string
+		expected bool
+	}{
+		{"", false},
+		{"abc-123", true},
+		{"4bf92f3577b34da6a3ce929d0e0e4736", true},
+		{"a b", false},
+		{"a\nb", false},
+		{"zażółć", false},
+		{strings.Repeat("a", maxRequestIDLen), true},
+		{strings.Repeat("a", maxRequestIDLen+1), false},
+	}
+	for _, test := range tests {
+		if ok := validRequestID(test.id); ok != test.expected {
+			t.Errorf("for %q expected %v but got %v", test.id, test.expected, ok)
+		}
+	}
+}
+
+func TestLoggedForm(t *testing.T) {
+	multipartBody := "--b\r\nContent-Disposition: form-data; name=\"login\"\r\n\r\nbob\r\n" +
+		"--b\r\nContent-Disposition: form-data; name=\"password\"\r\n\r\nsecret\r\n--b--\r\n"
+	tests := []struct {
+		contentType string
+		body        string
+		expected    string
+	}{
+		{"application/x-www-form-urlencoded", "text=abc&from=%2Fa&tag=x&tag=y", `from="/a" tag="x" tag="y" text="abc"`},
+		{"application/x-www-form-urlencoded", "login=bob&password=secret&submit_token=123&code=000111",
+			`code="[redacted]" login="bob" password="[redacted]" submit_token="[redacted]"`},
+		{"application/x-www-form-urlencoded", "text=" + strings.Repeat("ą", maxLoggedValue),
+			`text="` + strings.Repeat("ą", maxLoggedValue/2) + `…"`},
+		{"application/x-www-form-urlencoded", "a+b=%0A", `"a b"="\n"`},
+		{"multipart/form-data; boundary=b", multipartBody, `login="bob" password="[redacted]"`},
+		{"multipart/form-data; boundary=b", multipartBody[:strings.Index(multipartBody, "secret")], `login="bob"`},
+		{"application/json", `{"password":"secret"}`, ""},
+	}
+	for _, test := range tests {
+		if got := loggedForm(test.contentType, []byte(test.body)); got != test.expected {
+			t.Errorf("for %q expected %q but got %q", test.body, test.expected, got)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/_/api/add/submit", strings.NewReader("text=abc"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if got := readForm(r); got != `text="abc"` {
+		t.Errorf("unexpected logged form %q", got)
+	}
+	if r.FormValue("text") != "abc" {
+		t.Error("expected the request body to be restored after logging")
+	}
+}
+
+func TestCheckSchema(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	if err := db.CheckSchema(); err != nil {
+		t.Errorf("expected no error for initialized database but got: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "pns-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	empty, err := OpenDB(filepath.Join(dir, "empty.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer empty.db.Close()
+	if err := empty.CheckSchema(); err != ErrNotInit {
+		t.Errorf("expected ErrNotInit for empty database but got: %v", err)
+	}
+}
+
+func TestMigrationsOrder(t *testing.T) {
+	version := 1
+	for _, m := range migrations {
+		if m.version != version+1 {
+			t.Errorf("expected migration to db_version %d but got %d", version+1, m.version)
+		}
+		version = m.version
+	}
+	if version != dbVersion {
+		t.Errorf("expected last migration to db_version %d but got %d", dbVersion, version)
+	}
+}
+
+func TestExportSeparator(t *testing.T) {
+	created := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	notes := []*Note{
+		{ID: 1, Topics: []string{"/a"}, Created: created, Modified: created, Text: "***\ntext"},
+		{ID: 2, Topics: []string{"/b"}, Tags: []string{"c"}, Created: created, Modified: created, Text: "****"},
+	}
+	var b bytes.Buffer
+	if err := export(&b, notes, "*****", true); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(b.String(), "*****\n") {
+		t.Errorf("expected export to start with the separator but got %q", b.String())
+	}
+	parsed, err := parse(bytes.NewReader(b.Bytes()), "*****")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != len(notes) {
+		t.Fatalf("expected %d notes but got %d", len(notes), len(parsed))
+	}
+	for i, n := range parsed {
+		if n.Text != notes[i].Text {
+			t.Errorf("expected text %q but got %q", notes[i].Text, n.Text)
+		}
+	}
+	if _, err := parse(bytes.NewReader(b.Bytes()), "******"); err != ErrSeparator {
+		t.Errorf("expected ErrSeparator but got %v", err)
+	}
+	if err := export(&b, notes, "****", true); err == nil {
+		t.Error("expected error for separator occurring in a note")
+	}
+	if err := export(&b, notes, "**", true); err != ErrThreeStars {
+		t.Errorf("expected ErrThreeStars but got %v", err)
+	}
+}
+
+func TestGitBlobRoundTrip(t *testing.T) {
+	created := time.Date(2016, 1, 2, 3, 4, 5, 0, time.FixedZone("", 3600))
+	for _, text := range []string{
+		"",
+		"\n",
+		"\n\n",
+		"text",
+		"/a b\n2016-01-02 03:04:05 +0100\n\ntext",
+		"/x y\n2017-01-01 00:00:00 +0000\n\n/z\n2018-01-01 00:00:00 +0000\n\n",
+	} {
+		tags := []string{"/a", "b"}
+		gotTags, gotCreated, gotText, err := parseGitBlob(gitBlob(tags, created, text))
+		if err != nil {
+			t.Errorf("for %q got error: %v", text, err)
+			continue
+		}
+		if strings.Join(gotTags, " ") != "/a b" || !gotCreated.Equal(created) || gotText != text {
+			t.Errorf("for %q got (%q, %v, %q)", text, gotTags, gotCreated, gotText)
+		}
+	}
+	if _, _, _, err := parseGitBlob([]byte("/a b\n2016-01-02 03:04:05 +0100\ntext")); err == nil {
+		t.Error("expected error for missing empty line after the header")
+	}
+}
+
+func TestParseFrontMatter(t *testing.T) {
+	tests := []struct {
+		text, topics, tags, rest string
+		ok                       bool
+	}{
+		{"# Title\n", "", "", "# Title\n", false},
+		{"---\nno end\n", "", "", "---\nno end\n", false},
+		{"---\ntopics: [a, /b]\ntags: c d\n---\n# Title\n", "/a /b", "c d", "# Title\n", true},
+		{"---\ntitle: x\ntags:\n  - c\n  - /a\n---\ntext", "/a", "c", "text", true},
+		{"---\r\ntags: 'c', \"d\"\r\n---\r\n", "", "c d", "", true},
+		{"---\n---\ntext", "", "", "text", true},
+	}
+	for _, test := range tests {
+		topics, tags, rest, ok := parseFrontMatter(test.text)
+		if strings.Join(topics, " ") != test.topics || strings.Join(tags, " ") != test.tags || rest != test.rest || ok != test.ok {
+			t.Errorf("for %q expected (%q, %q, %q, %v) but got (%q, %q, %q, %v)", test.text, test.topics, test.tags, test.rest, test.ok, topics, tags, rest, ok)
+		}
+	}
+	text, topics, tags := mergeFrontMatter("---\ntags: c\n---\ntext", []string{"/a"}, []string{"c", "d"}, false)
+	if text != "text" || !reflect.DeepEqual(topics, []string{"/a"}) || !reflect.DeepEqual(tags, []string{"c", "d"}) {
+		t.Errorf("unexpected merge result (%q, %q, %q)", text, topics, tags)
+	}
+}
+
+func TestParseDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pns-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir = filepath.Join(dir, "notes")
+	files := map[string]string{
+		"a.md":            "# A\n",
+		"b.txt":           "skipped\n",
+		"work/x/c.md":     "# C\n",
+		"work/d.md":       "---\ntopics: [e]\ntags: f\n---\n# D\n",
+		"with space/g.md": "# G\n",
+	}
+	for name, text := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	notes, err := parseDir(dir, false)
+	if errs, ok := err.(MultiError); !ok || len(errs) != 1 {
+		t.Errorf("expected one error for the file in a directory with space but got %v", err)
+	}
+	var got []string
+	for _, n := range notes {
+		got = append(got, fmt.Sprintf("%s %s %s", strings.Join(n.Topics, ","), strings.Join(n.Tags, ","), n.Text))
+	}
+	expected := []string{"/notes  # A", "/e f # D", "/work/x  # C"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %q but got %q", expected, got)
+	}
+}
+
+func TestExportEmpty(t *testing.T) {
+	for _, sep := range []string{"", "*****"} {
+		var b bytes.Buffer
+		if err := export(&b, nil, sep, true); err != ErrNoNotes {
+			t.Errorf("for separator %q expected ErrNoNotes but got %v", sep, err)
+		}
+		if b.Len() != 0 {
+			t.Errorf("for separator %q expected nothing written but got %q", sep, b.String())
+		}
+	}
+}
+
+func TestExportToDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pns-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	created := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	notes := []*Note{
+		{ID: 3, Topics: []string{"/a", "/b/c"}, Tags: []string{"d"}, Created: created, Modified: created.Add(time.Hour), Text: "# Note\n\ntext"},
+		{ID: 7, Topics: []string{"/a"}, Created: created, Modified: created, Text: "---\nnot a front matter\n---"},
+	}
+	if err := exportToDir(dir, notes); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "3-note.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "---\ntopics: [/a, /b/c]\ntags: [d]\ncreated: 2016-01-02 03:04:05 +0000\nmodified: 2016-01-02 04:04:05 +0000\nlink: /_/n/3\n---\n# Note\n\ntext\n"
+	if string(b) != expected {
+		t.Errorf("expected %q but got %q", expected, b)
+	}
+	parsed, err := parseDir(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != len(notes) {
+		t.Fatalf("expected %d notes but got %d", len(notes), len(parsed))
+	}
+	for i, n := range parsed {
+		if strings.Join(n.Topics, " ") != strings.Join(notes[i].Topics, " ") || strings.Join(n.Tags, " ") != strings.Join(notes[i].Tags, " ") ||
+			!n.Created.Equal(notes[i].Created) || !n.Modified.Equal(notes[i].Modified) || n.Text != notes[i].Text {
+			t.Errorf("note %d differs after export and import: %+v", notes[i].ID, n)
+		}
+	}
+}
+
+func TestFrontMatterDates(t *testing.T) {
+	date := time.Date(2016, 1, 2, 3, 4, 5, 0, time.FixedZone("", 3600))
+	tests := []struct {
+		text              string
+		created, modified time.Time
+	}{
+		{"# Title\ncreated: 2016-01-02 03:04:05 +0100", time.Time{}, time.Time{}},
+		{"---\ncreated: 2016-01-02 03:04:05 +0100\n---\ntext", date, time.Time{}},
+		{"---\nmodified: '2016-01-02T03:04:05+01:00'\n---\n", time.Time{}, date},
+		{"---\ncreated: yesterday\nmodified: 2016-01-02 03:04:05 +0100\n---\n", time.Time{}, date},
+	}
+	for _, test := range tests {
+		created, modified := frontMatterDates(test.text)
+		if !created.Equal(test.created) || !modified.Equal(test.modified) {
+			t.Errorf("for %q expected (%v, %v) but got (%v, %v)", test.text, test.created, test.modified, created, modified)
+		}
+	}
+}
+
+func TestNoteSlug(t *testing.T) {
+	tests := []struct {
+		text, expected string
+	}{
+		{"", ""},
+		{"\n  Some text, here.\n# Title", "title"},
+		{"First   line -- with (punctuation)!\nsecond", "first-line-with-punctuation"},
+		{"## Zażółć gęślą jaźń", "zażółć-gęślą-jaźń"},
+		{"#", ""},
+		{strings.Repeat("ab ", 30), strings.TrimSuffix(strings.Repeat("ab-", 17), "-")},
+	}
+	for _, test := range tests {
+		n := Note{ID: 7, Text: test.text}
+		if got := n.Slug(); got != test.expected {
+			t.Errorf("for %q expected %q but got %q", test.text, test.expected, got)
+		}
+	}
+	n := Note{ID: 7, Text: "# Title"}
+	if got := n.Permalink(); got != "/_/note/7-title" {
+		t.Errorf("unexpected permalink %q", got)
+	}
+	if got := n.ShortLink(); got != "/_/n/7" {
+		t.Errorf("unexpected short link %q", got)
+	}
+}
+
+func TestCanonicalTagOrder(t *testing.T) {
+	created := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	n := &Note{ID: 7, Topics: []string{"/b", "/a/c", "/a-d", "/a"}, Tags: []string{"f", "+e", "d"}, Created: created, Modified: created, Text: "text"}
+	const expected = "/a /a/c /a-d /b +e d f"
+
+	var b bytes.Buffer
+	if _, err := n.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if line := strings.SplitN(b.String(), "\n", 2)[0]; line != expected {
+		t.Errorf("WriteTo: expected tags %q but got %q", expected, line)
+	}
+	blob := gitBlob(append(n.Tags, n.Topics...), created, n.Text)
+	if line := strings.SplitN(string(blob), "\n", 2)[0]; line != expected {
+		t.Errorf("gitBlob: expected tags %q but got %q", expected, line)
+	}
+	h := sha1.Sum([]byte(expected + "\x00" + n.Text))
+	if sum := n.sha1sum(); sum != hex.EncodeToString(h[:]) {
+		t.Errorf("sha1sum: expected sum of %q", expected)
+	}
+	if !reflect.DeepEqual(n.Topics, []string{"/b", "/a/c", "/a-d", "/a"}) {
+		t.Errorf("note topics modified: %q", n.Topics)
+	}
+}
+
+func TestTagCache(t *testing.T) {
+	var c tagCache
+	loads := 0
+	load := func() ([]string, []string, error) {
+		loads++
+		return []string{"/t"}, []string{fmt.Sprint("tag", loads)}, nil
+	}
+	tests := []struct {
+		invalidate bool
+		tags       []string
+		loads      int
+	}{
+		{false, []string{"tag1"}, 1},
+		{false, []string{"tag1"}, 1},
+		{true, []string{"tag2"}, 2},
+		{false, []string{"tag2"}, 2},
+	}
+	for i, test := range tests {
+		if test.invalidate {
+			c.invalidate()
+		}
+		_, tags, err := c.get(load)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tags, test.tags) || loads != test.loads {
+			t.Errorf("%d: expected %q after %d loads but got %q after %d loads", i, test.tags, test.loads, tags, loads)
+		}
+	}
+}
+
+func TestOpenDBMemory(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	if err := db.CheckSchema(); err != nil {
+		t.Fatal(err)
+	}
+	id, err := db.addNote("# Memory\n\ntext", []string{"/a", "b"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, cleanupOther := newTestDB(t)
+	defer cleanupOther()
+	tests := []struct {
+		db    *DB
+		count int
+	}{
+		{db, 1},
+		{other, 0},
+	}
+	for i, test := range tests {
+		notes, err := test.db.FTS("memory", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(notes) != test.count {
+			t.Errorf("%d: expected %d notes but got %d", i, test.count, len(notes))
+		} else if test.count > 0 && (notes[0].ID != id || !reflect.DeepEqual(notes[0].Tags, []string{"b"})) {
+			t.Errorf("%d: unexpected note %+v", i, notes[0])
+		}
+	}
+}
+
+func BenchmarkNotes(b *testing.B) {
+	db, cleanup := newTestDB(b)
+	defer cleanup()
+	for i := 0; i < 2*queryLimit; i++ {
+		if _, err := db.addNote(fmt.Sprint("# Note ", i), []string{"/a", fmt.Sprint("t", i%10)}, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.Notes("/a", nil, "", 0, orderByID, false, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSubmitTokens(t *testing.T) {
+	st := newSubmitTokens()
+	tests := []struct {
+		token    string
+		id       int64 // ID passed to End if Begin returned 0
+		expected int64
+	}{
+		{"", 1, 0},
+		{"", 2, 0},
+		{"a", 0, 0},
+		{"a", 3, 0},
+		{"a", 4, 3},
+		{"b", 5, 0},
+		{"b", 6, 5},
+		{strings.Repeat("c", maxSubmitTokenLen+1), 7, 0},
+		{strings.Repeat("c", maxSubmitTokenLen+1), 8, 0},
+	}
+	for i, test := range tests {
+		id := st.Begin(test.token)
+		if id != test.expected {
+			t.Errorf("%d: expected %d but got %d", i, test.expected, id)
+		}
+		if id == 0 {
+			st.End(test.token, test.id)
+		}
+	}
+
+	// concurrent submit waits for the first one
+	token := newSubmitToken()
+	if id := st.Begin(token); id != 0 {
+		t.Fatalf("unexpected ID %d for a new token", id)
+	}
+	c := make(chan int64)
+	go func() { c <- st.Begin(token) }()
+	st.End(token, 9)
+	if id := <-c; id != 9 {
+		t.Errorf("expected 9 but got %d", id)
+	}
+}
+
+func TestSubmitKey(t *testing.T) {
+	key := submitKey("a", "text", "/a b")
+	tests := []struct {
+		token   string
+		content []string
+		same    bool
+	}{
+		{"a", []string{"text", "/a b"}, true},
+		{"a", []string{"edited text", "/a b"}, false},
+		{"a", []string{"text", "/a"}, false},
+		{"a", []string{"text/a", " b"}, false},
+		{"b", []string{"text", "/a b"}, false},
+	}
+	for _, test := range tests {
+		if got := submitKey(test.token, test.content...); (got == key) != test.same || got == "" {
+			t.Errorf("unexpected key %q for %q %q", got, test.token, test.content)
+		}
+	}
+	if key := submitKey("", "text"); key != "" {
+		t.Errorf("expected empty key for empty token but got %q", key)
+	}
+	if key := submitKey(strings.Repeat("c", maxSubmitTokenLen+1), "text"); key != "" {
+		t.Errorf("expected empty key for too long token but got %q", key)
+	}
+}
+
+func TestQuestionMarks(t *testing.T) {
+	tests := []struct {
+		s        string
+		cnt      int
+		expected string
+	}{
+		{"?,", 0, ""},
+		{"?,", -1, ""},
+		{"?,", 1, "?"},
+		{"?,", 3, "?,?,?"},
+		{"(?,?),", 0, ""},
+		{"(?,?),", 2, "(?,?),(?,?)"},
+		{"", 2, ""},
+	}
+	for _, test := range tests {
+		if got := repeatNoLastChar(test.s, test.cnt); got != test.expected {
+			t.Errorf("repeatNoLastChar(%q, %d): expected %q but got %q", test.s, test.cnt, test.expected, got)
+		}
+		if test.s == "?," {
+			if got := questionMarks(test.cnt); got != test.expected {
+				t.Errorf("questionMarks(%d): expected %q but got %q", test.cnt, test.expected, got)
+			}
+		}
+	}
+}
+
+func TestExportPathTags(t *testing.T) {
+	tests := []struct {
+		path  string
+		topic string
+		tags  []string
+		ok    bool
+	}{
+		{"/a", "/a", []string{}, true},
+		{"/a/", "/a", []string{}, true},
+		{"/a/b/c", "/a", []string{"b", "c"}, true},
+		{"/a/b/", "/a", []string{"b"}, true},
+		{"/-/b", "/-", []string{"b"}, true},
+		{"a/b", "", nil, false},
+		{"//", "", nil, false},
+		{"//a", "", nil, false},
+		{"/a//b", "", nil, false},
+		{"/a/b//", "", nil, false},
+		{"/-", "", nil, false},
+		{"/-/", "", nil, false},
+	}
+	for _, test := range tests {
+		topic, tags, err := exportPathTags(test.path)
+		if (err == nil) != test.ok {
+			t.Errorf("for %q unexpected error %v", test.path, err)
+		} else if topic != test.topic || (test.ok && !reflect.DeepEqual(tags, test.tags)) {
+			t.Errorf("for %q expected %q %q but got %q %q", test.path, test.topic, test.tags, topic, tags)
+		}
+	}
+}
+
+func TestExportWithoutIDs(t *testing.T) {
+	created := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	notes := []*Note{
+		{ID: 1, Topics: []string{"/a"}, Created: created, Modified: created, Text: "first"},
+		{ID: 2, Topics: []string{"/b"}, Tags: []string{"c"}, Created: created, Modified: created, Text: "\nsecond"},
+	}
+	tests := []struct {
+		withIDs bool
+		ids     []int64
+	}{
+		{true, []int64{1, 2}},
+		{false, []int64{0, 0}},
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		if err := export(&b, notes, "***", test.withIDs); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(b.String(), "\n2\n") != test.withIDs {
+			t.Errorf("withIDs=%v: unexpected export %q", test.withIDs, b.String())
+		}
+		parsed, err := parse(bytes.NewReader(b.Bytes()), "")
+		if err != nil {
+			t.Fatalf("withIDs=%v: %v", test.withIDs, err)
+		}
+		if len(parsed) != len(notes) {
+			t.Fatalf("withIDs=%v: expected %d notes but got %d", test.withIDs, len(notes), len(parsed))
+		}
+		for i, n := range parsed {
+			if n.ID != test.ids[i] || n.Text != notes[i].Text || !reflect.DeepEqual(n.Tags, notes[i].Tags) {
+				t.Errorf("withIDs=%v: expected %+v but got %+v", test.withIDs, notes[i], n)
+			}
+		}
+	}
+}
+
+func TestNoteFirstLine(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{"# Title\n\ntext", "Title"},
+		{"\n  \nfirst line\nsecond", "first line"},
+		{"  ## Heading ##  ", "Heading ##"},
+		{"#\n\ntext", "text"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		n := Note{Text: test.text}
+		if got := n.FirstLine(); got != test.expected {
+			t.Errorf("for %q expected %q but got %q", test.text, test.expected, got)
+		}
+	}
+}
+
+func TestNotesViewURL(t *testing.T) {
+	tests := []struct {
+		path     string
+		compact  bool
+		expected string
+	}{
+		{"/a", false, "/a?view=compact"},
+		{"/a?view=compact", true, "/a"},
+		{"/a?sort=viewed&view=compact&start=100", true, "/a?sort=viewed&start=100"},
+		{"/?q=x", false, "/?q=x&view=compact"},
+		{"/?when=week&start=100", false, "/?when=week&start=100&view=compact"},
+	}
+	for _, test := range tests {
+		n := Notes{URL: test.path, Compact: test.compact}
+		if s := n.ViewURL(); s != test.expected {
+			t.Errorf("for %q expected %q but got %q", test.path, test.expected, s)
+		}
+	}
+	n := Notes{URL: "/", isHTML: true}
+	if s := n.ViewURL(); s != "" {
+		t.Errorf("expected no view URL for the index but got %q", s)
+	}
+	n = Notes{URL: "/a?view=compact&start=100", Start: 100}
+	if s := n.NextPage(); s != "/a?view=compact&start=200" {
+		t.Errorf("unexpected next page %q", s)
+	}
+}
+
+func TestTagsAliasing(t *testing.T) {
+	created := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	// topics and tags share the backing array with spare capacity
+	// of topics overlapping tags
+	newNote := func() *Note {
+		a := []string{"/a", "", "c", "b"}
+		return &Note{Topics: a[:1], Tags: a[2:4], Created: created, Modified: created, Text: "text"}
+	}
+	tests := []struct {
+		name string
+		f    func(n *Note) string
+	}{
+		{"concatTags", func(n *Note) string { return strings.Join(concatTags(n.Topics, n.Tags), " ") }},
+		{"sha1sum", func(n *Note) string { return n.sha1sum() }},
+		{"WriteTo", func(n *Note) string {
+			var b bytes.Buffer
+			n.WriteTo(&b)
+			return b.String()
+		}},
+		{"gitBlob", func(n *Note) string { return string(gitBlob(concatTags(n.Topics, n.Tags), n.Created, n.Text)) }},
+	}
+	for _, test := range tests {
+		n := newNote()
+		first := test.f(n)
+		if !reflect.DeepEqual(n.Topics, []string{"/a"}) || !reflect.DeepEqual(n.Tags, []string{"c", "b"}) {
+			t.Errorf("%s: note modified: topics %q tags %q", test.name, n.Topics, n.Tags)
+		}
+		if second := test.f(n); second != first {
+			t.Errorf("%s: expected %q on second call but got %q", test.name, first, second)
+		}
+	}
+	if got := strings.Join(concatTags(newNote().Topics, newNote().Tags), " "); got != "/a c b" {
+		t.Errorf("concatTags: unexpected %q", got)
+	}
+
+	var c tagCache
+	topics, _, _ := c.get(func() ([]string, []string, error) {
+		return append(make([]string, 0, 4), "/a"), []string{"b"}, nil
+	})
+	_ = append(topics, "x")
+	if cached, _, _ := c.get(nil); cap(cached) != len(cached) || len(cached) != 1 {
+		t.Errorf("cached topics may be modified by append: %q (cap %d)", cached, cap(cached))
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	s := &server{t: nopExecutor{}, tr: func(s string) string { return s }, maint: &maintenance{}}
+	tests := []struct {
+		query    string
+		code     int
+		expected bool
+	}{
+		{"", http.StatusOK, true},
+		{"", http.StatusOK, false},
+		{"?on=true", http.StatusOK, true},
+		{"?on=1", http.StatusOK, true},
+		{"?on=false", http.StatusOK, false},
+		{"?on=maybe", http.StatusBadRequest, false},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		s.serveAPIMaintenance(w, httptest.NewRequest("POST", "/_/api/maintenance"+test.query, nil))
+		if w.Code != test.code || s.maint.On() != test.expected {
+			t.Errorf("for %q expected %d (maintenance %v) but got %d (maintenance %v)", test.query, test.code, test.expected, w.Code, s.maint.On())
+		}
+	}
+
+	s.maint.Set(true)
+	w := httptest.NewRecorder()
+	s.serveAPIQuickAdd(w, httptest.NewRequest("POST", "/_/api/quickadd", strings.NewReader("/a\ntext")))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d in maintenance mode but got %d", http.StatusServiceUnavailable, w.Code)
+	}
+}
+
+func TestAuthenticateAPI(t *testing.T) {
+	s := &server{t: nopExecutor{}, s: NewSessions(), tr: func(s string) string { return s }}
+	h := s.authenticate(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		path, accept, requestedWith string
+		json                        bool
+	}{
+		{"/_/api/add/submit", "application/json", "", true},
+		{"/_/api/add/submit", "text/html, application/json;q=0.9", "", true},
+		{"/_/api/add/submit", "application/json", "XMLHttpRequest", false},
+		{"/_/api/add/submit", "*/*", "", false},
+		{"/_/add/", "application/json", "", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", test.path, nil)
+		r.Header.Set("Accept", test.accept)
+		if test.requestedWith != "" {
+			r.Header.Set("X-Requested-With", test.requestedWith)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		if json := w.Header().Get("Content-Type") == "application/json"; json != test.json {
+			t.Errorf("for %s (Accept: %q) expected JSON response %v but got %v", test.path, test.accept, test.json, json)
+		}
+		if strings.HasPrefix(test.path, "/_/api/") && w.Code != http.StatusUnauthorized {
+			t.Errorf("for %s expected status %d but got %d", test.path, http.StatusUnauthorized, w.Code)
+		}
+	}
+}
+
+func TestUsers(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	if logins, err := db.Users(); err != nil || len(logins) != 0 {
+		t.Fatalf("expected no users but got %q (%v)", logins, err)
+	}
+	for _, login := range []string{"bob", "alice"} {
+		if err := db.AddUser(login, []byte("secret123")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logins, err := db.Users()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"alice", "bob"}; !reflect.DeepEqual(logins, expected) {
+		t.Errorf("expected %q but got %q", expected, logins)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	db.maxFailures, db.lockout = 3, time.Hour
+	if err := db.AddUser("bob", []byte("secret123")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		password string
+		expected error
+	}{
+		{"secret123", nil},
+		{"wrong", ErrAuth},
+		{"wrong", ErrAuth},
+		{"secret123", nil}, // resets failed attempts
+		{"wrong", ErrAuth},
+		{"wrong", ErrAuth},
+		{"wrong", ErrAuth},     // locks the account
+		{"wrong", ErrAuth},     // not counted while locked
+		{"secret123", ErrAuth}, // the same error for the correct password
+	}
+	for i, test := range tests {
+		if err := db.AuthenticateUser("bob", []byte(test.password)); err != test.expected {
+			t.Errorf("%d: expected %v but got %v", i, test.expected, err)
+		}
+	}
+	if err := db.AuthenticateUser("alice", []byte("secret123")); err != ErrAuth {
+		t.Errorf("expected ErrAuth for unknown user but got %v", err)
+	}
+	if err := db.UnlockUser("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AuthenticateUser("bob", []byte("secret123")); err != nil {
+		t.Errorf("expected unlocked account but got %v", err)
+	}
+	if disabled, err := db.UserDisabled("bob"); err != nil || disabled {
+		t.Errorf("expected enabled account but got %v (%v)", disabled, err)
+	}
+	if err := db.DisableUser("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AuthenticateUser("bob", []byte("secret123")); err != ErrAuth {
+		t.Errorf("expected ErrAuth for disabled account but got %v", err)
+	}
+	if err := db.AuthenticateUser("bob", []byte("wrong")); err != ErrAuth {
+		t.Errorf("expected ErrAuth for disabled account but got %v", err)
+	}
+	if disabled, err := db.UserDisabled("bob"); err != nil || !disabled {
+		t.Errorf("expected disabled account but got %v (%v)", disabled, err)
+	}
+	if disabled, err := db.UserDisabled("alice"); err != nil || !disabled {
+		t.Errorf("expected unknown user to be disabled but got %v (%v)", disabled, err)
+	}
+	if err := db.UnlockUser("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AuthenticateUser("bob", []byte("secret123")); err != nil {
+		t.Errorf("expected account enabled again but got %v", err)
+	}
+	if err := db.UnlockUser("alice"); err != ErrNoUser {
+		t.Errorf("expected ErrNoUser but got %v", err)
+	}
+	if err := db.DisableUser("alice"); err != ErrNoUser {
+		t.Errorf("expected ErrNoUser but got %v", err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	for i := 1; i <= 2; i++ {
+		if _, err := db.addNote(fmt.Sprint("note ", i), []string{"/a", "b"}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	created := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	notes := []*Note{
+		{ID: 2, Text: "merged 2", Topics: []string{"/a"}, Tags: []string{"c"}, Created: created, Modified: created},
+		{ID: 5, Text: "merged 5", Tags: []string{"b", "d"}, Created: created, Modified: created},
+	}
+	addedNotes, addedTags, err := db.Merge(notes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addedNotes != 2 || addedTags != 2 {
+		t.Errorf("expected 2 added notes and 2 added tags but got %d and %d", addedNotes, addedTags)
+	}
+	tests := []struct {
+		id     int64
+		text   string
+		topics []string
+		tags   []string
+	}{
+		{1, "note 1", []string{"/a"}, []string{"b"}},
+		{2, "note 2", []string{"/a"}, []string{"b"}},
+		{5, "merged 5", nil, []string{"b", "d"}},
+		{6, "merged 2", []string{"/a"}, []string{"c"}}, // ID 2 already used
+	}
+	for _, test := range tests {
+		n, err := db.Note(test.id)
+		if err != nil {
+			t.Errorf("note %d: %v", test.id, err)
+			continue
+		}
+		if n.Text != test.text || !reflect.DeepEqual(n.Topics, test.topics) || !reflect.DeepEqual(n.Tags, test.tags) {
+			t.Errorf("note %d: expected %q %q %q but got %q %q %q", test.id, test.text, test.topics, test.tags, n.Text, n.Topics, n.Tags)
+		}
+	}
+	var cnt int
+	if err := db.db.QueryRow("SELECT COUNT(*) FROM tagnames").Scan(&cnt); err != nil || cnt != 4 {
+		t.Errorf("expected 4 tag names (existing ones reused) but got %d (%v)", cnt, err)
+	}
+	if changed, err := db.LastChange(); err != nil || time.Since(changed) > time.Minute {
+		t.Errorf("expected change recorded for notes modified earlier but got %v (%v)", changed, err)
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	if err := db.AddUser("bob", []byte("secret123")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.VerifyTOTP("bob", ""); err != nil {
+		t.Errorf("expected no error without two-factor authentication but got %v", err)
+	}
+	secret, err := db.EnableTOTP("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := totpCode(secret, time.Now().Unix()/totpPeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		code     string
+		expected error
+	}{
+		{"", ErrTOTPRequired},
+		{code, nil},
+		{code, ErrAuth}, // already used
+	}
+	for i, test := range tests {
+		if err := db.VerifyTOTP("bob", test.code); err != test.expected {
+			t.Errorf("%d: expected %v but got %v", i, test.expected, err)
+		}
+	}
+}
+
+func TestTrash(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	id, err := db.addNote("# Note", []string{"/a"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := db.Note(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.DeleteNote(id); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.DeleteNote(id); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for note already in the trash but got %v", err)
+	}
+	if _, err = db.Note(id); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for note in the trash but got %v", err)
+	}
+	if err = db.updateNote(id, "# Edited", []string{"/a"}, n.sha1sum()); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows when editing note in the trash but got %v", err)
+	}
+	if notes, err := db.TrashNotes(); err != nil || len(notes) != 1 || notes[0].ID != id {
+		t.Errorf("expected note %d in the trash but got %v (%v)", id, notes, err)
+	}
+	if err = db.RestoreNote(id); err != nil {
+		t.Fatal(err)
+	}
+	if n, err = db.Note(id); err != nil || n.Text != "# Note" {
+		t.Errorf("expected restored note but got %v (%v)", n, err)
+	}
+	if notes, err := db.TrashNotes(); err != nil || len(notes) != 0 {
+		t.Errorf("expected empty trash but got %v (%v)", notes, err)
+	}
+	if err = db.DeleteNote(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.db.Exec("DELETE FROM pns WHERE key='last_change'"); err != nil {
+		t.Fatal(err)
+	}
+	if k, err := db.EmptyTrash(time.Now().Add(-time.Hour)); err != nil || k != 0 {
+		t.Errorf("expected no notes removed from the trash but got %d (%v)", k, err)
+	}
+	if changed, err := db.LastChange(); err != nil || !changed.IsZero() {
+		t.Errorf("expected no change recorded but got %v (%v)", changed, err)
+	}
+	if k, err := db.EmptyTrash(time.Now().Add(time.Hour)); err != nil || k != 1 {
+		t.Errorf("expected one note removed from the trash but got %d (%v)", k, err)
+	}
+	if changed, err := db.LastChange(); err != nil || time.Since(changed) > time.Minute {
+		t.Errorf("expected change recorded for removed notes but got %v (%v)", changed, err)
+	}
+	if err = db.RestoreNote(id); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for removed note but got %v", err)
+	}
+}
+
+func TestSyncCursor(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	old := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	notes := []*Note{{Topics: []string{"/a"}, Created: old, Modified: old, Text: "x"}}
+	if err := db.Import(notes, false); err != nil {
+		t.Fatal(err)
+	}
+	// makeOld makes the trash and the recorded changes look as if
+	// they happened long ago
+	makeOld := func() {
+		_, err := db.db.Exec("UPDATE notes SET deleted_at=? WHERE deleted_at>0", old)
+		if err == nil {
+			_, err = db.db.Exec("DELETE FROM pns WHERE key='last_change'")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Truncate(time.Second)
+	steps := []struct {
+		name   string
+		change func() error
+	}{
+		{"delete", func() error { return db.DeleteNote(1) }},
+		{"restore", func() error { makeOld(); return db.RestoreNote(1) }},
+		{"purge", func() error {
+			if err := db.DeleteNote(1); err != nil {
+				return err
+			}
+			makeOld()
+			_, err := db.EmptyTrash(time.Now())
+			return err
+		}},
+	}
+	for _, step := range steps {
+		if err := step.change(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if _, cursor, err := db.SyncCursor(); err != nil || cursor.Before(start) {
+			t.Errorf("%s: expected cursor not before %v but got %v (%v)", step.name, start, cursor, err)
+		}
+	}
+}
+
+func TestOrphanNotes(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	for i := 0; i < 3; i++ {
+		if _, err := db.addNote(fmt.Sprint("# Note ", i), []string{"/a", "b"}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ids, err := db.OrphanNotes(); err != nil || len(ids) != 0 {
+		t.Fatalf("expected no orphan notes but got %v (%v)", ids, err)
+	}
+	if _, err := db.db.Exec("DELETE FROM tags WHERE noteid IN (2, 3)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteNote(3); err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := db.OrphanNotes(); err != nil || !reflect.DeepEqual(ids, []int64{2, 3}) {
+		t.Fatalf("expected orphan notes 2 and 3 but got %v (%v)", ids, err)
+	}
+	if ids, err := db.TagOrphanNotes("/orphan"); err != nil || !reflect.DeepEqual(ids, []int64{2}) {
+		t.Fatalf("expected tagged note 2 (not the one in the trash) but got %v (%v)", ids, err)
+	}
+	if ids, err := db.OrphanNotes(); err != nil || !reflect.DeepEqual(ids, []int64{3}) {
+		t.Errorf("expected only orphan note 3 in the trash after tagging but got %v (%v)", ids, err)
+	}
+	n, err := db.Note(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(n.Topics, []string{"/orphan"}) || len(n.Tags) != 0 {
+		t.Errorf("expected topic /orphan but got %q %q", n.Topics, n.Tags)
+	}
+}
+
+func TestActivityByDay(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	for i := 0; i < 2; i++ {
+		if _, err := db.addNote(fmt.Sprint("# Note ", i), []string{"/a"}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now().In(location)
+	from, to, err := activityRange("", "", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	days, err := db.ActivityByDay(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]int{now.Format("2006-01-02"): 2}; !reflect.DeepEqual(days, expected) {
+		t.Errorf("expected %v but got %v", expected, days)
+	}
+}
+
+func TestCheckFTSConsistency(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	for i := 0; i < 3; i++ {
+		if _, err := db.addNote(fmt.Sprint("# Note ", i), []string{"/a"}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.CheckFTSConsistency(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.db.Exec("DELETE FROM ftsnotes WHERE docid=2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CheckFTSConsistency(); err != (FTSMismatchError{3, 2}) {
+		t.Errorf("expected FTSMismatchError but got %v", err)
+	}
+	if n, err := db.Reindex(); err != nil || n != 3 {
+		t.Fatalf("reindex: %d %v", n, err)
+	}
+	if err := db.CheckFTSConsistency(); err != nil {
+		t.Error(err)
+	}
+	if notes, err := db.FTS("note", 0); err != nil || len(notes) != 3 {
+		t.Errorf("expected 3 notes found after reindex but got %d (%v)", len(notes), err)
+	}
+}
+
+func TestRelevance(t *testing.T) {
+	matchinfo := func(a ...uint32) []byte {
+		b := make([]byte, 4*len(a))
+		for i, v := range a {
+			nativeEndian.PutUint32(b[4*i:], v)
+		}
+		return b
+	}
+	// one phrase, columns note and title, 10 rows
+	tests := []struct {
+		name string
+		b    []byte
+		ok   bool
+	}{
+		{"none", matchinfo(1, 2, 10, 0, 5, 5, 0, 1, 1), true},
+		{"rare", matchinfo(1, 2, 10, 1, 1, 1, 0, 0, 0), true},
+		{"common", matchinfo(1, 2, 10, 1, 9, 9, 0, 0, 0), true},
+		{"title", matchinfo(1, 2, 10, 1, 1, 1, 1, 1, 1), true},
+		{"short", matchinfo(1, 2, 10, 1), false},
+		{"odd", []byte{1, 2, 3}, false},
+	}
+	scores := make(map[string]float64)
+	for _, test := range tests {
+		score, err := relevance(test.b)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		scores[test.name] = score
+	}
+	if scores["none"] != 0 || !(scores["rare"] > scores["common"]) || !(scores["title"] > scores["rare"]) {
+		t.Errorf("unexpected scores %v", scores)
+	}
+
+	ranked := []rankedNote{{1, 30, 1}, {2, 20, 2}, {3, 10, 1}, {4, 10, 1}}
+	sort.Sort(byRelevance(ranked))
+	var ids []int64
+	for _, r := range ranked {
+		ids = append(ids, r.id)
+	}
+	if !reflect.DeepEqual(ids, []int64{2, 3, 4, 1}) {
+		t.Errorf("unexpected order %v", ids)
+	}
+}
+
+func TestEventHubReplay(t *testing.T) {
+	h := newEventHub()
+	c, missed, gap := h.Subscribe(0)
+	if missed != nil || gap {
+		t.Fatalf("unexpected missed events %v (gap %v)", missed, gap)
+	}
+	h.Publish(NoteEvent{1, "add", 0})
+	first := <-c
+	h.Publish(NoteEvent{1, "update", 0})
+	h.Publish(NoteEvent{2, "add", 0})
+	h.Unsubscribe(c)
+	if first.seq <= 0 {
+		t.Fatalf("unexpected event ID %d", first.seq)
+	}
+
+	c, missed, gap = h.Subscribe(first.seq)
+	defer h.Unsubscribe(c)
+	if gap || len(missed) != 2 || missed[0].Type != "update" || missed[1].ID != 2 {
+		t.Errorf("unexpected missed events %v (gap %v)", missed, gap)
+	}
+	if _, missed, gap = h.Subscribe(first.seq + 2); missed != nil || gap {
+		t.Errorf("unexpected missed events %v (gap %v) when up to date", missed, gap)
+	}
+	if _, _, gap = h.Subscribe(first.seq - 10); !gap {
+		t.Error("expected gap for unknown event ID")
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2016 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"unsafe"
+)
+
+// FTS4 has no built-in ranking function so relevance of full text
+// search results is computed from matchinfo(ftsnotes, 'pcnx'), which
+// is an array of 32-bit unsigned integers in the native byte order:
+// the number of phrases (p) and columns (c) of the query, the number
+// of rows (n) and then for each phrase and column the number of hits
+// in the current row, in all rows and the number of rows with a hit
+// (x).
+
+// columnWeights are the weights of hits in the note and title columns
+// of ftsnotes.
+var columnWeights = []float64{1, 2}
+
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 0 {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+var errMatchinfo = errors.New("malformed matchinfo")
+
+// relevance returns tf-idf score of a row given its matchinfo blob
+// (see above), higher is better.
+func relevance(matchinfo []byte) (float64, error) {
+	if len(matchinfo)%4 != 0 {
+		return 0, errMatchinfo
+	}
+	a := make([]uint32, len(matchinfo)/4)
+	for i := range a {
+		a[i] = nativeEndian.Uint32(matchinfo[4*i:])
+	}
+	if len(a) < 3 {
+		return 0, errMatchinfo
+	}
+	phrases, cols, rows := int(a[0]), int(a[1]), float64(a[2])
+	x := a[3:]
+	if len(x) != 3*phrases*cols {
+		return 0, errMatchinfo
+	}
+	var score float64
+	for p := 0; p < phrases; p++ {
+		for c := 0; c < cols; c++ {
+			hits, docs := x[3*(p*cols+c)], x[3*(p*cols+c)+2]
+			if hits == 0 || docs == 0 {
+				continue
+			}
+			w := 1.0
+			if c < len(columnWeights) {
+				w = columnWeights[c]
+			}
+			score += w * float64(hits) * math.Log(1+rows/float64(docs))
+		}
+	}
+	return score, nil
+}
+
+// rankedNote is a note ID with its relevance score.
+type rankedNote struct {
+	id      int64
+	created int64
+	score   float64
+}
+
+// byRelevance sorts the best matches first (and the oldest first
+// among equally relevant notes).
+type byRelevance []rankedNote
+
+func (a byRelevance) Len() int      { return len(a) }
+func (a byRelevance) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+
+func (a byRelevance) Less(i, j int) bool {
+	if a[i].score != a[j].score {
+		return a[i].score > a[j].score
+	}
+	if a[i].created != a[j].created {
+		return a[i].created < a[j].created
+	}
+	return a[i].id < a[j].id
+}
@@ -6,7 +6,9 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"sort"
 	"sync"
 	"time"
 )
@@ -19,21 +21,36 @@ type sessions struct {
 }
 
 type session struct {
-	expires time.Time
-	client  time.Time // the time session was send to the client
+	expires  time.Time
+	duration time.Duration // session is extended by duration on every use
+	client   time.Time     // the time session was send to the client
+	created  time.Time
+	used     time.Time // the time session was last checked
+	listing  string    // URL of the last notes listing shown
+	login    string    // login of the user
+}
+
+// SessionInfo describes a session without exposing the session ID.
+type SessionInfo struct {
+	Handle  string // identifies the session (see RemoveHandle)
+	Created time.Time
+	Used    time.Time
+	Expires time.Time
+	Current bool
 }
 
 func NewSessions() *sessions {
 	return &sessions{m: make(map[string]*session)}
 }
 
-// NewSession returns new random session ID. It also stores the
-// session ID later authentication. It also stores session expiration
-// time and time of sending the session cookie to the client. The
-// session cookie send to the client should have max age equal to
-// twice the duration given as argument to NewSession so the session
-// is properly extended with following calls to CheckSession.
-func (s *sessions) NewSession(d time.Duration) (string, error) {
+// NewSession returns new random session ID of the user with the given
+// login. It also stores the session ID later authentication. It also
+// stores session expiration time and time of sending the session
+// cookie to the client. The session cookie send to the client should
+// have max age equal to twice the duration given as argument to
+// NewSession so the session is properly extended with following calls
+// to CheckSession.
+func (s *sessions) NewSession(login string, d time.Duration) (string, error) {
 	var a [16]byte
 	_, err := rand.Read(a[:])
 	if err != nil {
@@ -49,32 +66,67 @@ func (s *sessions) NewSession(d time.Duration) (string, error) {
 	if len(s.m) == 0 || t.Before(s.next) {
 		s.next = t
 	}
-	s.m[v] = &session{t, now} // now: we treat the new session cookie as already send
+	s.m[v] = &session{t, d, now, now, now, "", login} // now: we treat the new session cookie as already send
 	s.expire()
 	return v, nil
 }
 
 // CheckSession returns error (ErrAuth) on invalid or expired sessions
-// and nil on a proper session.  Additionally the first return value
-// indicates whether a new session cookie should be send to the
-// client.  The session cookie send to the client should have max age
-// equal to twice the duration given as argument to NewSession so the
+// and nil on a proper session.  The session is extended by the
+// duration given as argument to NewSession.  Additionally if a new
+// session cookie should be send to the client the first return value
+// is that duration (and zero otherwise).  The session cookie send to
+// the client should have max age equal to twice that duration so the
 // session is properly extended with following calls to CheckSession.
-func (s *sessions) CheckSession(v string, d time.Duration) (bool, error) {
+func (s *sessions) CheckSession(v string) (time.Duration, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.expire()
 	entry, present := s.m[v]
 	if !present {
-		return false, ErrAuth
+		return 0, ErrAuth
 	}
 	now := time.Now()
+	d := entry.duration
 	entry.expires = now.Add(d)
+	entry.used = now
 	if now.Sub(entry.client) > d/2 {
 		entry.client = now // we treat the new session cookie as already sent
-		return true, nil
+		return d, nil
+	}
+	return 0, nil
+}
+
+// SetListing stores URL of the last notes listing shown in the
+// session.
+func (s *sessions) SetListing(v, url string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, present := s.m[v]; present {
+		entry.listing = url
+	}
+}
+
+// Listing returns URL of the last notes listing shown in the session
+// or empty string if none.
+func (s *sessions) Listing(v string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, present := s.m[v]; present {
+		return entry.listing
+	}
+	return ""
+}
+
+// Login returns the login of the user of the session or empty string
+// if there is no such session.
+func (s *sessions) Login(v string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, present := s.m[v]; present {
+		return entry.login
 	}
-	return false, nil
+	return ""
 }
 
 func (s *sessions) Remove(v string) {
@@ -83,6 +135,68 @@ func (s *sessions) Remove(v string) {
 	delete(s.m, v)
 }
 
+// Count returns the number of active sessions.
+func (s *sessions) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	return len(s.m)
+}
+
+// List returns active sessions of the user with given login, the most
+// recently created first. The session with ID current is marked as the
+// current one.
+func (s *sessions) List(login, current string) []SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	list := make([]SessionInfo, 0, len(s.m))
+	for k, v := range s.m {
+		if v.login == login {
+			list = append(list, SessionInfo{sessionHandle(k), v.created, v.used, v.expires, k == current})
+		}
+	}
+	sort.Sort(sessionsByCreated(list))
+	return list
+}
+
+// RemoveHandle removes the session of the user with given login with
+// the given handle (see SessionInfo) and reports whether it was found.
+func (s *sessions) RemoveHandle(login, handle string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range s.m {
+		if v.login == login && sessionHandle(k) == handle {
+			delete(s.m, k)
+			return true
+		}
+	}
+	return false
+}
+
+// sessionHandle returns a handle identifying the session from which
+// the session ID cannot be recovered.
+func sessionHandle(v string) string {
+	h := sha256.Sum256([]byte(v))
+	return hex.EncodeToString(h[:8])
+}
+
+type sessionsByCreated []SessionInfo
+
+func (a sessionsByCreated) Len() int           { return len(a) }
+func (a sessionsByCreated) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a sessionsByCreated) Less(i, j int) bool { return a[i].Created.After(a[j].Created) }
+
+// Clear removes all the sessions (so that all the users need to log in
+// again) and returns the number of removed sessions.
+func (s *sessions) Clear() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.m)
+	s.m = make(map[string]*session)
+	return n
+}
+
 // expire removes expired sessions. The map with with sessions is only
 // iterated if some session is already expired. Caller should lock the
 // mutex before calling expire.
@@ -0,0 +1,11 @@
+// Copyright 2016 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+// +build windows plan9
+
+package main
+
+// toggleMaintenanceOnSignal does nothing as there is no SIGUSR1 on
+// this platform (use /_/api/maintenance instead).
+func toggleMaintenanceOnSignal(m *maintenance) {}
@@ -0,0 +1,25 @@
+// Copyright 2016 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+// +build !windows,!plan9
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// toggleMaintenanceOnSignal toggles the maintenance mode on SIGUSR1.
+func toggleMaintenanceOnSignal(m *maintenance) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	go func() {
+		for range c {
+			log.Printf("maintenance mode: %v (SIGUSR1)", m.Toggle())
+		}
+	}()
+}
@@ -2,6 +2,20 @@
 // reserved.  This source code is licensed under the terms of the MIT
 // license. See LICENSE file for details.
 
+// basePath is the path prefix pns is served under (see -base_path),
+// given in the data-base attribute of the script element (as the
+// script may be served from elsewhere, see -static_base_url).
+var basePath = document.currentScript.getAttribute("data-base") || "";
+
+// staticBase is the base URL of the static assets (the URL of this
+// script without the file name).
+var staticBase = document.currentScript.src.replace(/\/pns\.js(\?.*)?$/, "");
+
+// listingPath returns the path of the current page without basePath.
+function listingPath() {
+	return location.pathname.substring(basePath.length);
+}
+
 function getLayoutCompletions(value) {
 	var m = value.match(/\s*[+-]/);
 	if (m != null) {
@@ -50,7 +64,7 @@ function getPreview(action) {
 	var errorMsg = document.getElementById("error-msg");
 	var req = new XMLHttpRequest();
 	if (action == "Help") {
-		req.open("GET", "/_/static/help-" + lang + ".html");
+		req.open("GET", basePath + "/_/static/help-" + lang + ".html");
 	} else {
 		req.open("POST", form.getAttribute("action"));
 	}
@@ -94,7 +108,13 @@ function editSubmit() {
 	var req = new XMLHttpRequest();
 	req.open("POST", form.getAttribute("action"));
 	req.onerror = function() {
-		errorMsg.innerHTML = connErrMsg;
+		if (form.getAttribute("action") == basePath + "/_/api/add/submit" && !navigator.onLine) {
+			var token = form.elements["submit_token"];
+			queueNote(form.elements["tag"].value, form.elements["text"].value, token ? token.value : "");
+			errorMsg.innerHTML = queuedMsg;
+		} else {
+			errorMsg.innerHTML = connErrMsg;
+		}
 		document.getElementById("error").setAttribute("class", "");
 		preview.innerHTML = "";
 	};
@@ -117,6 +137,46 @@ function editSubmit() {
 	return false;
 }
 
+// queueNote stores a note added when offline to be submitted by
+// submitQueuedNotes when back online. The note keeps its submit token
+// so that it is added once even if submitted from several tabs.
+function queueNote(tag, text, token) {
+	if (!token) {
+		token = Date.now().toString(36) + Math.random().toString(36).slice(2);
+	}
+	var queue = JSON.parse(localStorage.getItem("pnsQueue") || "[]");
+	queue.push({tag: tag, text: text, token: token});
+	localStorage.setItem("pnsQueue", JSON.stringify(queue));
+}
+
+function submitQueuedNotes() {
+	var queue = JSON.parse(localStorage.getItem("pnsQueue") || "[]");
+	if (queue.length == 0 || !navigator.onLine) {
+		return;
+	}
+	var note = queue[0];
+	var req = new XMLHttpRequest();
+	req.open("POST", basePath + "/_/api/add/submit");
+	req.onload = function() {
+		if (req.status == 200 || req.status == 400) {
+			// on 400 (e.g., no topics or tags) the note would never
+			// be accepted so it is dropped not to block the queue
+			queue = JSON.parse(localStorage.getItem("pnsQueue") || "[]");
+			queue.shift();
+			localStorage.setItem("pnsQueue", JSON.stringify(queue));
+			submitQueuedNotes();
+		}
+	};
+	var data = new FormData();
+	data.append("action", "Submit");
+	data.append("tag", note.tag);
+	data.append("text", note.text);
+	if (note.token) {
+		data.append("submit_token", note.token);
+	}
+	req.send(data);
+}
+
 function modalLogin(response, callback) {
 	loginCallback = callback;
 	var login = document.getElementById("login");
@@ -151,7 +211,7 @@ function loginOnClick(callback) {
 		loginMsg.firstChild.nodeValue = msg;
 		document.getElementById("modal_login").checked = true;
 	}
-	r.open("POST", "/_/api/login");
+	r.open("POST", basePath + "/_/api/login");
 		r.onerror = function() {
 			showError(document.getElementById("connection_error").firstChild.nodeValue);
 		};
@@ -161,6 +221,7 @@ function loginOnClick(callback) {
 		} else {
 			loginName.value = "";
 			password.value = "";
+			document.getElementById("code").value = "";
 			loginName.focus();
 			showError(r.response);
 		}
@@ -168,6 +229,10 @@ function loginOnClick(callback) {
 	var data = new FormData();
 	data.append("login", loginName.value);
 	data.append("password", password.value);
+	data.append("code", document.getElementById("code").value);
+	if (document.getElementById("remember").checked) {
+		data.append("remember", "1");
+	}
 	r.send(data);
 	return false;
 }
@@ -190,17 +255,17 @@ function noteKeyDown(event) {
 	} else if (event.keyCode == 69 && (event.altKey || id != "tag")) { // "e" -- edit
 		if (id.substring(0, 4) == "note") {
 			var n = id.substring(4, id.length);
-			document.location = "/_/edit/" + n;
+			document.location = basePath + "/_/edit/" + n + "?from=" + encodeURIComponent(listingPath());
 		}
 		return false;
 	} else if (event.keyCode == 67 && (event.altKey || id != "tag")) { // "c" -- copy
 		if (id.substring(0, 4) == "note") {
 			var n = id.substring(4, id.length);
-			document.location = "/_/copy/" + n;
+			document.location = basePath + "/_/copy/" + n + "?from=" + encodeURIComponent(listingPath());
 		}
 		return false;
 	} else if (event.keyCode == 65 && (event.altKey || id != "tag")) { // "a" -- add
-		document.location = "/_/add";
+		document.location = basePath + "/_/add?from=" + encodeURIComponent(listingPath());
 		return false;
 	} else if (event.keyCode == 76) { // "l" -- location
 		if (id == "tag") {
@@ -258,3 +323,54 @@ function focusCurrentNote() {
 		focusNote(0);
 	}
 }
+
+if ("serviceWorker" in navigator) {
+	navigator.serviceWorker.register(basePath + "/_/sw.js?static=" + encodeURIComponent(staticBase),
+					 {scope: basePath + "/"});
+}
+window.addEventListener("online", submitQueuedNotes);
+submitQueuedNotes();
+
+// updateRelativeTimes updates relative times of notes (elements with
+// the data-time attribute) as the page may have been rendered long ago
+// (e.g., when it is served from the browser cache).
+function updateRelativeTimes() {
+	if (typeof relativeFormats == "undefined") {
+		return;
+	}
+	var now = Date.now() / 1000;
+	var elems = document.querySelectorAll("[data-time]");
+	for (var i = 0; i < elems.length; i++) {
+		elems[i].textContent = relativeTime(now - elems[i].getAttribute("data-time"));
+	}
+}
+
+// relativeTime returns d seconds in the largest whole units (as
+// relativeTime in notes.go).
+function relativeTime(d) {
+	var units = relativeFormats.Units;
+	for (var i = 0; i < units.length; i++) {
+		if (d >= units[i].Seconds) {
+			var n = Math.floor(d / units[i].Seconds);
+			return units[i][pluralForm(n)].replace("%d", n);
+		}
+	}
+	return relativeFormats.JustNow;
+}
+
+// pluralForm returns the plural form of n (as pluralForm in notes.go).
+function pluralForm(n) {
+	if (n == 1) {
+		return "One";
+	} else if (n % 10 >= 2 && n % 10 <= 4 && (n % 100 < 12 || n % 100 > 14)) {
+		return "Few";
+	}
+	return "Many";
+}
+
+if (document.readyState == "loading") {
+	document.addEventListener("DOMContentLoaded", updateRelativeTimes);
+} else {
+	updateRelativeTimes();
+}
+setInterval(updateRelativeTimes, 60 * 1000);
@@ -0,0 +1,77 @@
+// Copyright 2016 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+// Service worker caching the add note page and static assets so that
+// a note may be written (and queued for submission, see pns.js) when
+// offline.
+
+var cacheName = "pns-v2";
+
+// path prefix pns is served under (see -base_path)
+var basePath = location.pathname.replace(/\/_\/sw\.js$/, "");
+
+// base URL of the static assets given by pns.js (which may be on
+// another origin, see -static_base_url)
+var staticBase = new URL(new URL(location).searchParams.get("static") ||
+			 basePath + "/_/static", location).href;
+
+var cachedURLs = [new URL(basePath + "/_/add", location).href].concat([
+	"style.css",
+	"awesomplete.css",
+	"awesomplete.js",
+	"pns.js",
+	"favicon.png"
+].map(function(name) {
+	return staticBase + "/" + name;
+}));
+
+// cacheable tells whether the response may be cached (responses to
+// requests to other origins are opaque so their status is unknown).
+function cacheable(response) {
+	return (response.ok && !response.redirected) || response.type == "opaque";
+}
+
+self.addEventListener("install", function(event) {
+	event.waitUntil(caches.open(cacheName).then(function(cache) {
+		return Promise.all(cachedURLs.map(function(url) {
+			var mode = new URL(url).origin == location.origin ? "same-origin" : "no-cors";
+			return fetch(new Request(url, {mode: mode})).then(function(response) {
+				if (!cacheable(response)) {
+					throw new Error("failed to fetch " + url);
+				}
+				return cache.put(url, response);
+			});
+		}));
+	}));
+});
+
+self.addEventListener("activate", function(event) {
+	event.waitUntil(caches.keys().then(function(names) {
+		return Promise.all(names.filter(function(name) {
+			return name != cacheName;
+		}).map(function(name) {
+			return caches.delete(name);
+		}));
+	}));
+});
+
+// network first so that the cached copies are only used when offline
+self.addEventListener("fetch", function(event) {
+	var url = new URL(event.request.url);
+	var key = url.origin + url.pathname;
+	if (event.request.method != "GET" || cachedURLs.indexOf(key) < 0) {
+		return;
+	}
+	event.respondWith(fetch(event.request).then(function(response) {
+		if (cacheable(response)) {
+			var copy = response.clone();
+			caches.open(cacheName).then(function(cache) {
+				cache.put(key, copy);
+			});
+		}
+		return response;
+	}).catch(function() {
+		return caches.match(key);
+	}));
+});
@@ -0,0 +1,147 @@
+// Copyright 2016 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"sync"
+	"time"
+)
+
+// submitTokenTTL is how long a used submit token is remembered.
+const submitTokenTTL = 10 * time.Minute
+
+// maxSubmitTokenLen is the maximum length of submit tokens accepted
+// from the client (longer ones are ignored).
+const maxSubmitTokenLen = 64
+
+// submitTokens remembers notes added with given submit tokens (sent
+// with the add note form) so that a repeated submit of the same form
+// does not add the note again.
+type submitTokens struct {
+	mu   sync.Mutex
+	m    map[string]*submitted
+	next time.Time
+}
+
+type submitted struct {
+	expires time.Time
+	done    chan struct{} // closed when the note is added (or failed)
+	id      int64         // ID of the added note (valid after done)
+}
+
+func newSubmitTokens() *submitTokens {
+	return &submitTokens{m: make(map[string]*submitted)}
+}
+
+// newSubmitToken returns a new random submit token.
+func newSubmitToken() string {
+	var a [16]byte
+	if _, err := rand.Read(a[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(a[:])
+}
+
+// submitKey returns the key under which a submit of the given content
+// with the given submit token is remembered, so that submitting the
+// form again after editing it adds another note. The key is empty for
+// an empty or too long token.
+func submitKey(token string, content ...string) string {
+	if token == "" || len(token) > maxSubmitTokenLen {
+		return ""
+	}
+	h := sha1.New()
+	io.WriteString(h, token)
+	for _, c := range content {
+		h.Write([]byte{0})
+		io.WriteString(h, c)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Begin should be called before adding a note with the given submit
+// token. If a note was already added with the token its ID is
+// returned, otherwise zero is returned and End must be called after
+// the note is added. If the same token is being submitted
+// concurrently Begin waits for the first submit to finish.
+func (t *submitTokens) Begin(token string) int64 {
+	if token == "" || len(token) > maxSubmitTokenLen {
+		return 0
+	}
+	for {
+		t.mu.Lock()
+		t.expire()
+		e, present := t.m[token]
+		if !present {
+			expires := time.Now().Add(submitTokenTTL)
+			if len(t.m) == 0 || expires.Before(t.next) {
+				t.next = expires
+			}
+			t.m[token] = &submitted{expires, make(chan struct{}), 0}
+			t.mu.Unlock()
+			return 0
+		}
+		t.mu.Unlock()
+		<-e.done
+		if e.id > 0 {
+			return e.id
+		}
+		// the first submit failed so try again
+	}
+}
+
+// End records the ID of the note added with the given submit token
+// (zero if adding the note failed so that the token may be used
+// again).
+func (t *submitTokens) End(token string, id int64) {
+	if token == "" || len(token) > maxSubmitTokenLen {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, present := t.m[token]
+	if !present {
+		return
+	}
+	if id > 0 {
+		e.id = id
+	} else {
+		delete(t.m, token)
+	}
+	close(e.done)
+}
+
+func (t *submitTokens) expire() {
+	if len(t.m) == 0 {
+		return
+	}
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now.Add(submitTokenTTL)
+		for k, v := range t.m {
+			if v.expires.Before(now) && v.finished() {
+				delete(t.m, k)
+			} else if v.expires.Before(t.next) {
+				t.next = v.expires
+			}
+		}
+	}
+}
+
+// finished reports whether adding the note has finished (the entry
+// of a submit in progress must not be removed as End would not find
+// it).
+func (e *submitted) finished() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2016 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import "sync"
+
+// tagCache keeps the list of all the topics and tags so that it is
+// not read from the database on every request to the home page.
+type tagCache struct {
+	mu     sync.Mutex
+	valid  bool
+	gen    uint64 // incremented on every invalidation
+	topics []string
+	tags   []string
+}
+
+// get returns the cached topics and tags. If the cache is not valid
+// load is called and its result is stored unless the cache was
+// invalidated in the meantime.
+func (c *tagCache) get(load func() ([]string, []string, error)) ([]string, []string, error) {
+	c.mu.Lock()
+	if c.valid {
+		topics, tags := c.topics, c.tags
+		c.mu.Unlock()
+		return topics, tags, nil
+	}
+	gen := c.gen
+	c.mu.Unlock()
+
+	topics, tags, err := load()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// limit capacity so that appending to the returned slices
+	// never modifies the cached ones
+	topics, tags = topics[:len(topics):len(topics)], tags[:len(tags):len(tags)]
+	if c.gen == gen {
+		c.valid, c.topics, c.tags = true, topics, tags
+	}
+	return topics, tags, nil
+}
+
+// invalidate drops the cached topics and tags.
+func (c *tagCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.valid, c.topics, c.tags = false, nil, nil
+}
@@ -29,41 +29,114 @@ var enTranslation = translation{
 
 	"login|Submit": "Submit",
 	"edit|Submit":  "Submit",
+
+	"one|%d minutes ago":  "%d minute ago",
+	"few|%d minutes ago":  "%d minutes ago",
+	"many|%d minutes ago": "%d minutes ago",
+	"one|%d hours ago":    "%d hour ago",
+	"few|%d hours ago":    "%d hours ago",
+	"many|%d hours ago":   "%d hours ago",
+	"one|%d days ago":     "%d day ago",
+	"few|%d days ago":     "%d days ago",
+	"many|%d days ago":    "%d days ago",
+	"one|%d months ago":   "%d month ago",
+	"few|%d months ago":   "%d months ago",
+	"many|%d months ago":  "%d months ago",
+	"one|%d years ago":    "%d year ago",
+	"few|%d years ago":    "%d years ago",
+	"many|%d years ago":   "%d years ago",
 }
 
 var plTranslation = translation{
 	"lang-code": "pl",
 
 	"# No such notes":                 "# Brak takich notatek",
+	"# Trash is empty":                "# Kosz jest pusty",
 	"Add note":                        "Dodaj notatkę",
+	"Back to results":                 "Powrót do wyników",
 	"Bad request: error parsing form": "Błędne zapytanie: błąd parsowania formularza",
+	"Bad request: error reading body": "Błędne zapytanie: błąd odczytu treści",
+	"Bad request: on parameter must be true or false": "Błędne zapytanie: parametr on musi mieć wartość true lub false",
+	"Bad request: min and max parameters expected": "Błędne zapytanie: oczekiwano parametrów min i max",
+	"Bad request: start parameter too large": "Błędne zapytanie: zbyt duży parametr start",
+	"Bad request: when parameter must be today or week": "Błędne zapytanie: parametr when musi mieć wartość today lub week",
+	"Bad request: from and to parameters must be dates such as 2006-01-02": "Błędne zapytanie: parametry from i to muszą być datami takimi jak 2006-01-02",
+	"Paging is limited to the first %d notes.": "Stronicowanie jest ograniczone do pierwszych %d notatek.",
 	"Cancel":            "Anuluj",
 	"Connection error.": "Błąd połączenia.",
 	"Copy":              "Kopiuj",
+	"Created":           "Utworzono",
+	"Delete":            "Usuń",
 	"Diff":              "Porównaj",
 	"Edit":              "Edytuj",
 	"Error":             "Błąd",
 	"Incorrect login or password.": "Niepoprawny login lub hasło.",
 	"Internal server error":        "Wewnętrzny błąd serwera",
+	"Link to source":               "Powiąż ze źródłem",
 	"Login":                        "Login",
 	"Logout":                       "Wyloguj",
 	"Method not allowed":           "Niedozwolona metoda",
 	"No differences found.":        "Nie znaleziono żadnych zmian.",
 	"Page not found":               "Strona nie istnieje",
 	"Password":                     "Hasło",
+	"Remember me":                  "Zapamiętaj mnie",
 	"Please specify at least one topic or tag.": "Proszę podać conajmniej jeden temat lub etykietę.",
 	"Please use POST.":                          "Proszę użyć POST.",
 	"Preview":                                   "Podgląd",
+	"Related":                                   "Powiązane",
+	"Oldest first":                              "Najstarsze najpierw",
+	"Least recently viewed":                     "Najdawniej oglądane",
+	"Best matches first":                        "Najlepiej pasujące najpierw",
+	"Compact view":                              "Widok zwięzły",
+	"Full view":                                 "Widok pełny",
+	"Ignore whitespace":                         "Ignoruj białe znaki",
+	"Number of edits":                           "Liczba edycji",
+	"Maximum number of notes reached.":          "Osiągnięto maksymalną liczbę notatek.",
+	"Please enter the authentication code.":      "Proszę podać kod uwierzytelniający.",
+	"Authentication code (if enabled)":           "Kod uwierzytelniający (jeśli włączony)",
+	"You are offline, the note will be submitted when back online.": "Jesteś offline, notatka zostanie zapisana po przywróceniu połączenia.",
+	"The note is too long.":                     "Notatka jest zbyt długa.",
+	"Maintenance in progress, notes cannot be modified now. Please try again later.": "Trwają prace konserwacyjne, notatek nie można teraz zmieniać. Spróbuj ponownie później.",
+	"Maintenance in progress, logging in is not possible now. Please try again later.": "Trwają prace konserwacyjne, logowanie nie jest teraz możliwe. Spróbuj ponownie później.",
+	"Subtopics":                                 "Podtematy",
+	"Sessions":                                  "Sesje",
+	"Last used":                                 "Ostatnio używana",
+	"Expires":                                   "Wygasa",
+	"Revoke":                                    "Unieważnij",
+	"current session":                           "bieżąca sesja",
+	"Created today":                             "Utworzone dzisiaj",
+	"Created in the last 7 days":                "Utworzone w ciągu ostatnich 7 dni",
+	"just now":                                  "przed chwilą",
+	"one|%d minutes ago":                        "minutę temu",
+	"few|%d minutes ago":                        "%d minuty temu",
+	"many|%d minutes ago":                       "%d minut temu",
+	"one|%d hours ago":                          "godzinę temu",
+	"few|%d hours ago":                          "%d godziny temu",
+	"many|%d hours ago":                         "%d godzin temu",
+	"one|%d days ago":                           "dzień temu",
+	"few|%d days ago":                           "%d dni temu",
+	"many|%d days ago":                          "%d dni temu",
+	"one|%d months ago":                         "miesiąc temu",
+	"few|%d months ago":                         "%d miesiące temu",
+	"many|%d months ago":                        "%d miesięcy temu",
+	"one|%d years ago":                          "rok temu",
+	"few|%d years ago":                          "%d lata temu",
+	"many|%d years ago":                         "%d lat temu",
+	"Restore":                                   "Przywróć",
 	"Search...":                                 "Szukaj...",
 	"Tags":                                      "Etykiety",
 	"Topics and tags":                           "Tematy i etykiety",
 	"Topics":                                    "Tematy",
+	"Trash":                                     "Kosz",
 	"edit|Submit":                               "Zapisz",
+	"copy of":                                   "kopia",
 	"login|Submit":                              "Zaloguj się",
 	"unsupported action":                        "Niewspierana akcja",
 	`" and "`:                                   `" i "`,
 	`Conflicting edits detected. Please join the changes and click "Submit" again when done.`:                 `Wykryto konflikt edycji. Proszę połącz zmiany i gdy zakończysz kliknij ponownie "Zapisz"`,
 	`Note that the following tags/topics are new: "%s".`:                                                      `Zauważ, że następujące tematy/etykiety są nowe: "%s".`,
+	`Note that the following tags/topics differing only by the leading "/" already exist: "%s".`:              `Zauważ, że istnieją już następujące tematy/etykiety różniące się jedynie początkowym "/": "%s".`,
+	`Note that the following tags/topics are repeated: "%s".`:                                                 `Zauważ, że następujące tematy/etykiety są powtórzone: "%s".`,
 	`Note to login you need to have <a href="https://en.wikipedia.org/wiki/HTTP_cookie">cookies</a> enabled.`: `Aby się zalogować musisz mieć aktywne <a href="https://en.wikipedia.org/wiki/HTTP_cookie">cookie</a>.`,
 	`You are adding the following tags/topics: "%s".`:                                                         `Dodajesz następujące tematy/etykiety: "%s".`,
 	`You are removing the following tags/topics: "%s".`:                                                       `Usuwasz następujące tematy/etykiety: "%s".`,
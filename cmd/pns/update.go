@@ -6,34 +6,57 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const maxInt = int(^uint(0) >> 1)
 
-func updateDB(db *DB, filename string, useGit bool, lang string) error {
+// updateDB adds pns table to a database created before it was
+// introduced and (if useGit is true) creates git repository with the
+// history of all notes. In dry run mode the changes are rolled back
+// and only printed to standard output.
+func updateDB(db *DB, filename string, useGit bool, lang string, dryRun bool) error {
 	tx, err := db.db.Begin()
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	err = createPNSTable(tx, useGit, lang)
+	// databases without pns table have schema of db_version 1
+	err = createPNSTable(tx, 1, useGit, lang)
+	for _, m := range migrations {
+		if err != nil {
+			break
+		}
+		err = runMigration(tx, m)
+	}
 	if err != nil {
 		return err
 	}
+	if dryRun {
+		fmt.Printf("dry run: would create table pns (db_version=%d, use_git=%v, lang=%s)\n", dbVersion, useGit, lang)
+	}
 	if !useGit {
+		if dryRun {
+			return nil
+		}
 		return tx.Commit()
 	}
-	notes, err := db.AllNotes()
+	notes, err := allNotes(tx)
 	if err != nil {
 		return err
 	}
+	if dryRun {
+		fmt.Printf("dry run: would create git repository %s and commit %d notes\n", filename+".git", len(notes))
+		return nil
+	}
 	g := NewGitRepo(filename + ".git")
 	if err := g.Init(); err != nil {
 		return err
@@ -46,15 +69,10 @@ func updateDB(db *DB, filename string, useGit bool, lang string) error {
 		return errors.New("git: unexpected commits in fresh created repository")
 	}
 
-	var b bytes.Buffer
 	var parent SHA1
 	p := NewProgress(len(notes))
 	for i, n := range notes {
-		tags := strings.Join(append(n.Topics, n.Tags...), " ")
-		b.Reset()
-		fmt.Fprintf(&b, "%s\n%s\n\n%s", tags, n.Created.Format(timeLayout), n.Text)
-
-		h, err := g.hashObject(objectBlob, b.Bytes())
+		h, err := g.hashObject(objectBlob, gitBlob(concatTags(n.Topics, n.Tags), n.Created, n.Text))
 		if err != nil {
 			return err
 		}
@@ -90,6 +108,163 @@ func updateDB(db *DB, filename string, useGit bool, lang string) error {
 	return tx.Commit()
 }
 
+type migration struct {
+	version int // db_version after the migration
+	migrate func(tx *sql.Tx) error
+}
+
+// migrations upgrading the database schema, ordered by version. The
+// version of the last one must be equal to dbVersion.
+var migrations = []migration{
+	{2, func(tx *sql.Tx) error {
+		_, err := tx.Exec("ALTER TABLE notes ADD COLUMN deleted_at INTEGER NOT NULL DEFAULT 0")
+		return err
+	}},
+	{3, func(tx *sql.Tx) error {
+		_, err := tx.Exec("ALTER TABLE notes ADD COLUMN copied_from INTEGER NOT NULL DEFAULT 0")
+		return err
+	}},
+	{4, migrateFTSTitle},
+	{5, func(tx *sql.Tx) error {
+		_, err := tx.Exec("ALTER TABLE notes ADD COLUMN last_viewed INTEGER NOT NULL DEFAULT 0")
+		return err
+	}},
+	{6, func(tx *sql.Tx) error {
+		_, err := tx.Exec("ALTER TABLE users ADD COLUMN failed_attempts INTEGER NOT NULL DEFAULT 0")
+		if err == nil {
+			_, err = tx.Exec("ALTER TABLE users ADD COLUMN locked_until INTEGER NOT NULL DEFAULT 0")
+		}
+		return err
+	}},
+	{7, func(tx *sql.Tx) error {
+		_, err := tx.Exec("ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT ''")
+		return err
+	}},
+	{8, func(tx *sql.Tx) error {
+		_, err := tx.Exec("CREATE INDEX IF NOT EXISTS notesCreated ON notes (created)")
+		if err == nil {
+			_, err = tx.Exec("CREATE INDEX IF NOT EXISTS notesModified ON notes (modified)")
+		}
+		return err
+	}},
+	{9, func(tx *sql.Tx) error {
+		_, err := tx.Exec("ALTER TABLE users ADD COLUMN totp_step INTEGER NOT NULL DEFAULT 0")
+		return err
+	}},
+}
+
+// migrateFTSTitle adds title column to the full text search index
+// (used by title:foo searches). As FTS tables cannot be altered the
+// index is recreated.
+func migrateFTSTitle(tx *sql.Tx) error {
+	if _, err := tx.Exec("CREATE VIRTUAL TABLE ftsnotes_new USING fts4(note, title)"); err != nil {
+		return err
+	}
+	rows, err := tx.Query("SELECT docid, note FROM ftsnotes")
+	if err != nil {
+		return err
+	}
+	var (
+		ids   []int64
+		texts []string
+	)
+	for rows.Next() {
+		var id int64
+		var text string
+		if err := rows.Scan(&id, &text); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+		texts = append(texts, text)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+	for i, id := range ids {
+		_, err := tx.Exec("INSERT INTO ftsnotes_new (docid, note, title) VALUES (?, ?, ?)", id, texts[i], noteTitle(texts[i]))
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DROP TABLE ftsnotes"); err != nil {
+		return err
+	}
+	_, err = tx.Exec("ALTER TABLE ftsnotes_new RENAME TO ftsnotes")
+	return err
+}
+
+// Migrate upgrades the database created by an older version of PNS
+// to the current db_version. Each migration is run in a separate
+// transaction.
+func (db *DB) Migrate() error {
+	var value string
+	if err := db.db.QueryRow("SELECT value FROM pns WHERE key='db_version'").Scan(&value); err != nil {
+		return fmt.Errorf("error reading db_version: %v", err)
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("error parsing db_version: %v", err)
+	}
+	if version > dbVersion {
+		return fmt.Errorf("unsupported db_version %d (newer than %d)", version, dbVersion)
+	}
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		tx, err := db.db.Begin()
+		if err != nil {
+			return err
+		}
+		if err = runMigration(tx, m); err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return nil
+}
+
+func runMigration(tx *sql.Tx, m migration) error {
+	if err := m.migrate(tx); err != nil {
+		return fmt.Errorf("migration to db_version %d failed: %v", m.version, err)
+	}
+	_, err := tx.Exec("UPDATE pns SET value=? WHERE key='db_version'", strconv.Itoa(m.version))
+	return err
+}
+
+// gitBlob returns contents of the git file of a note. The first line
+// is the space separated list of topics and tags (which never contain
+// white space) in canonical order (see canonicalOrder), the second
+// line is the creation time, the third line is empty and the rest (up
+// to the end of the file) is the text of the note. As the header has a
+// fixed number of lines the text is recovered unambiguously whatever
+// it contains (see parseGitBlob).
+func gitBlob(tags []string, created time.Time, text string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s\n%s\n\n%s", strings.Join(canonicalTags(tags), " "), created.Format(timeLayout), text)
+	return b.Bytes()
+}
+
+// parseGitBlob parses contents of the git file of a note written by
+// gitBlob.
+func parseGitBlob(b []byte) (tags []string, created time.Time, text string, err error) {
+	header := bytes.SplitN(b, []byte{'\n'}, 4)
+	if len(header) != 4 || len(header[2]) != 0 {
+		return nil, time.Time{}, "", errors.New("invalid git note header")
+	}
+	created, err = time.Parse(timeLayout, string(header[1]))
+	if err != nil {
+		return nil, time.Time{}, "", err
+	}
+	return strings.Fields(string(header[0])), created, string(header[3]), nil
+}
+
 func idToGitName(id int64) string {
 	s := strconv.FormatInt(id, 10)
 	if len(s)&1 == 1 {